@@ -0,0 +1,319 @@
+package storytime
+
+// A JSON API under /api/v1/, for clients other than the web pages.
+// Callers are identified by a personal API token (see tokens.go), or
+// else the same way as for the pages.  Posts must be JSON, which (unlike
+// forms) other sites can't make browsers send, so there's no need for
+// CSRF tokens.
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A story as seen through the API.
+type apiStory struct {
+	Id         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	Creator    string    `json:"creator"`
+	Authors    []string  `json:"authors"`
+	TurnOrder  string    `json:"turnOrder"`
+	NextAuthor string    `json:"nextAuthor,omitempty"`
+	Modified   time.Time `json:"modified"`
+	Complete   bool      `json:"complete"`
+	Archived   bool      `json:"archived"`
+	Words      int       `json:"words"`
+	WordsLeft  int       `json:"wordsLeft"`
+	EndRule    string    `json:"endRule"`
+	// How an active story will end.
+	Ending string    `json:"ending,omitempty"`
+	Parts  []apiPart `json:"parts"`
+}
+
+// A part of a story.  Hidden is withheld until the story is complete.
+type apiPart struct {
+	Author  string    `json:"author"`
+	Written time.Time `json:"written"`
+	Hidden  string    `json:"hidden,omitempty"`
+	Visible string    `json:"visible"`
+}
+
+// The caller's turn in a story.  PartId is the token for submitting it.
+type apiTurn struct {
+	Story       apiStory  `json:"story"`
+	PartId      string    `json:"partId"`
+	LastVisible string    `json:"lastVisible,omitempty"`
+	Expires     time.Time `json:"expires"`
+	// Limits on the part's length, in lengthUnit: "" for characters, or
+	// "words".  WordQuota is how many words the author is asked for.
+	LengthUnit string `json:"lengthUnit"`
+	MinLength  int    `json:"minLength"`
+	MaxLength  int    `json:"maxLength"`
+	WordQuota  int    `json:"wordQuota,omitempty"`
+	// Whether this is the story's last part, and if so, the most words it
+	// may have (or 0 for no limit beyond MaxLength).
+	Closing         bool `json:"closing"`
+	ClosingMaxWords int  `json:"closingMaxWords,omitempty"`
+	// How much of the part the next author will see: "" for the last
+	// VisibleWords words of the last line, "sentence" or "line".
+	VisibleMode  string `json:"visibleMode"`
+	VisibleWords int    `json:"visibleWords"`
+}
+
+// Body of a request to begin a story.
+type apiBegin struct {
+	Authors       []string  `json:"authors"`
+	TurnOrder     string    `json:"turnOrder"`
+	Words         int       `json:"words"`
+	EndRule       string    `json:"endRule"`
+	EndCount      int       `json:"endCount"`
+	Deadline      time.Time `json:"deadline"` // for the "deadline" rule
+	ReminderHours int       `json:"reminderHours"`
+	TimeoutHours  int       `json:"timeoutHours"`
+	VisibleMode   string    `json:"visibleMode"`
+	VisibleWords  int       `json:"visibleWords"`
+	LengthUnit    string    `json:"lengthUnit"`
+	MinLength     int       `json:"minLength"`
+	MaxLength     int       `json:"maxLength"`
+	WordQuota     int       `json:"wordQuota"`
+}
+
+// Body of a request to submit a part.
+type apiSubmit struct {
+	PartId string `json:"partId"`
+	Text   string `json:"text"`
+}
+
+// Body of every error response.
+type apiError struct {
+	Error apiErrorDetail `json:"error"`
+}
+
+type apiErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newAPIStory(story Story) apiStory {
+	s := apiStory{
+		Id:        story.Id,
+		Created:   story.Created,
+		Creator:   story.Creator,
+		Authors:   story.Authors,
+		TurnOrder: story.TurnOrder,
+		Modified:  story.Modified,
+		Complete:  story.Complete,
+		Archived:  story.Archived,
+		Words:     story.Words,
+		WordsLeft: story.WordsLeft(),
+		EndRule:   story.EndRule,
+		Parts:     make([]apiPart, len(story.Parts)),
+	}
+	if story.Active() {
+		s.NextAuthor = story.NextAuthor
+		s.Ending = story.EndDescription()
+	}
+	for i, part := range story.Parts {
+		s.Parts[i] = apiPart{Author: part.Author, Written: part.Written, Visible: part.Visible}
+		if story.Complete {
+			s.Parts[i].Hidden = part.Hidden
+		}
+	}
+	return s
+}
+
+func newAPITurn(story Story) *apiTurn {
+	turn := &apiTurn{
+		Story:      newAPIStory(story),
+		PartId:     story.NextId,
+		Expires:    story.TurnExpires(),
+		LengthUnit: story.LengthUnit,
+		MinLength:  story.MinLength,
+		MaxLength:  story.MaxPartLength(),
+		WordQuota:  story.WordQuota,
+
+		Closing:         story.ClosingTurn(),
+		ClosingMaxWords: story.ClosingMaxWords(),
+
+		VisibleMode:  story.VisibleMode,
+		VisibleWords: story.VisibleWordCount(),
+	}
+	if part := story.LastPart(); part != nil {
+		turn.LastVisible = part.Visible
+	}
+	return turn
+}
+
+// Response that writes a value as JSON.
+type jsonResponse struct {
+	code  int
+	value interface{}
+}
+
+func (r jsonResponse) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(r.code)
+	json.NewEncoder(w).Encode(r.value)
+}
+
+func jsonError(code int, message string) jsonResponse {
+	return jsonResponse{code, apiError{apiErrorDetail{code, message}}}
+}
+
+// Handler for API requests.  Like appHandler, handlers may panic to
+// return early, but everything (errors included) is turned into JSON.
+type apiHandler func(request) response
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if e := recover(); e != nil {
+			apiRecover(r, e).Write(w)
+		}
+	}()
+	if r.Method == "POST" {
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			jsonError(http.StatusUnsupportedMediaType, "Requests must be JSON").Write(w)
+			return
+		}
+	}
+	req := newRequest(r)
+	if u := apiTokenUser(req); u != nil {
+		req.auth.user, req.auth.checked = u, true
+	}
+	resp := fn(req)
+	if _, ok := resp.(jsonResponse); !ok {
+		resp = apiRecover(r, resp)
+	}
+	resp.Write(w)
+}
+
+// Turns whatever a handler panicked with (or returned, if it wasn't
+// JSON) into a JSON error.
+func apiRecover(r *http.Request, e interface{}) jsonResponse {
+	switch e := e.(type) {
+	case jsonResponse:
+		return e
+	case *appError:
+		host.errorf(r, "%v", e.Error)
+		return jsonError(e.Code, e.Message)
+	case errorResponse:
+		return jsonError(e.code, e.message)
+	case *errorPage:
+		return jsonError(e.Code, e.Message)
+	case redirectResponse:
+		// Only userRequired redirects, to log in.
+		return jsonError(http.StatusUnauthorized, "Not logged in")
+	default:
+		host.errorf(r, "%v", e)
+		return jsonError(http.StatusInternalServerError, fmt.Sprintf("%v", e))
+	}
+}
+
+// Decodes the JSON request body into v.
+func decodeBody(r request, v interface{}) {
+	if err := json.NewDecoder(r.req.Body).Decode(v); err != nil {
+		panic(jsonError(http.StatusBadRequest, "Could not parse request: "+err.Error()))
+	}
+}
+
+// Handles everything under /api/v1/.
+func api(r request) response {
+	u := r.userRequired()
+	get, post := r.req.Method == "GET", r.req.Method == "POST"
+	if args := r.matchPath("/api/v1/stories/:storyId/parts"); args != nil && post {
+		return apiSubmitPart(r, u, (*args)["storyId"])
+	} else if args := r.matchPath("/api/v1/stories/:storyId"); args != nil && get {
+		return apiFetchStory(r, u, (*args)["storyId"])
+	} else if r.matchPath("/api/v1/stories") != nil && get {
+		return apiInProgress(r, u)
+	} else if r.matchPath("/api/v1/stories") != nil && post {
+		return apiBeginStory(r)
+	} else if r.matchPath("/api/v1/turn") != nil && get {
+		return apiCurrentTurn(r, u)
+	} else if r.matchPath("/api/v1/turns") != nil && get {
+		return apiTurns(r, u)
+	}
+	return jsonError(http.StatusNotFound, "Not Found")
+}
+
+// GET /api/v1/stories: the caller's in-progress stories.
+func apiInProgress(r request, u *User) response {
+	stories := make([]apiStory, 0)
+	for _, story := range r.store().InProgressStories(u.Email) {
+		stories = append(stories, newAPIStory(story))
+	}
+	return jsonResponse{http.StatusOK, stories}
+}
+
+// GET /api/v1/stories/ID: a story, if it's finished or the caller is
+// one of its authors.
+func apiFetchStory(r request, u *User, id string) response {
+	story := r.store().FetchStory(id)
+	if story == nil || !story.Deleted.IsZero() ||
+		!(story.Complete || story.Archived || story.HasAuthor(u.Email) || u.Admin) {
+		return jsonError(http.StatusNotFound, "No such story")
+	}
+	return jsonResponse{http.StatusOK, newAPIStory(*story)}
+}
+
+// GET /api/v1/turn: the caller's current story, or null.
+func apiCurrentTurn(r request, u *User) response {
+	story := r.store().CurrentStory(u.Email)
+	if story == nil {
+		return jsonResponse{http.StatusOK, nil}
+	}
+	return jsonResponse{http.StatusOK, newAPITurn(*story)}
+}
+
+// GET /api/v1/turns: every story waiting on the caller, oldest first.
+func apiTurns(r request, u *User) response {
+	turns := make([]*apiTurn, 0)
+	for _, story := range r.store().InProgressStories(u.Email) {
+		if story.NextAuthor == u.Email {
+			turns = append(turns, newAPITurn(story))
+		}
+	}
+	return jsonResponse{http.StatusOK, turns}
+}
+
+// POST /api/v1/stories: begins a new story.
+func apiBeginStory(r request) response {
+	var body apiBegin
+	decodeBody(r, &body)
+	authors := parseAuthors(strings.Join(body.Authors, ","))
+	story := newStory(r, authors, storyOptions{
+		Words:         body.Words,
+		TurnOrder:     body.TurnOrder,
+		EndRule:       body.EndRule,
+		EndCount:      body.EndCount,
+		Deadline:      body.Deadline,
+		ReminderHours: body.ReminderHours,
+		TimeoutHours:  body.TimeoutHours,
+		VisibleMode:   body.VisibleMode,
+		VisibleWords:  body.VisibleWords,
+		LengthUnit:    body.LengthUnit,
+		MinLength:     body.MinLength,
+		MaxLength:     body.MaxLength,
+		WordQuota:     body.WordQuota,
+	})
+	return jsonResponse{http.StatusCreated, newAPIStory(story)}
+}
+
+// POST /api/v1/stories/ID/parts: writes the caller's part, returning
+// the updated story.
+func apiSubmitPart(r request, u *User, id string) response {
+	var body apiSubmit
+	decodeBody(r, &body)
+	story, denied := turnStory(r, id, body.PartId)
+	if denied != nil {
+		return jsonError(denied.Code, denied.Message)
+	} else if problem := story.checkPartLength(body.Text); problem != "" {
+		return jsonError(http.StatusBadRequest, problem)
+	}
+	savePart(r, story, body.Text)
+	return jsonResponse{http.StatusOK, newAPIStory(*story)}
+}
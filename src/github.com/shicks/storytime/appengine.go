@@ -0,0 +1,127 @@
+//go:build appengine
+// +build appengine
+
+package storytime
+
+import (
+	"net/http"
+	"os"
+
+	"appengine"
+	"appengine/mail"
+	"appengine/urlfetch"
+	"appengine/user"
+	"appengine/xmpp"
+)
+
+// The deployment's settings come from env_variables in app.yaml.
+func init() {
+	var notifier Notifier = appengineNotifier{}
+	if server := os.Getenv("STORYTIME_CHAT_SERVER"); server != "" {
+		notifier = WithMatrixChat(notifier, server, os.Getenv("STORYTIME_CHAT_TOKEN"))
+	}
+	register(http.DefaultServeMux, Config{
+		BaseURL:     os.Getenv("STORYTIME_BASE_URL"),
+		Sender:      os.Getenv("STORYTIME_SENDER"),
+		ReplyDomain: os.Getenv("STORYTIME_REPLY_DOMAIN"),
+		ResourceDir: "src/github.com/shicks/storytime",
+		Notifier:    notifier,
+	}, appenginePlatform{})
+}
+
+// Platform backed by the App Engine services.
+type appenginePlatform struct{}
+
+func (appenginePlatform) store(r *http.Request) StoryStore {
+	return newDatastoreStore(appengine.NewContext(r))
+}
+
+func (appenginePlatform) user(r *http.Request) *User {
+	if u := user.Current(appengine.NewContext(r)); u != nil {
+		return &User{u.Email, u.Admin}
+	}
+	return nil
+}
+
+// App Engine admins sign in with their Google accounts.
+func (appenginePlatform) admin(email string) bool {
+	return false
+}
+
+func (appenginePlatform) loginURL(r *http.Request, dest string) string {
+	url, err := user.LoginURL(appengine.NewContext(r), dest)
+	if err != nil {
+		panic(err)
+	}
+	return url
+}
+
+func (appenginePlatform) logoutURL(r *http.Request) string {
+	url, err := user.LogoutURL(appengine.NewContext(r), "/")
+	if err != nil {
+		panic(err)
+	}
+	return url
+}
+
+func (appenginePlatform) httpClient(r *http.Request) *http.Client {
+	return urlfetch.Client(appengine.NewContext(r))
+}
+
+// urlfetch can't be told which addresses it may connect to, so each
+// request's host (including redirects) is checked just before it's fetched.
+func (appenginePlatform) webhookClient(r *http.Request) *http.Client {
+	client := urlfetch.Client(appengine.NewContext(r))
+	client.Transport = publicOnlyTransport{client.Transport}
+	return client
+}
+
+// Transport that refuses requests to hosts without public addresses.
+type publicOnlyTransport struct {
+	http.RoundTripper
+}
+
+func (t publicOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkPublicHost(req.URL); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Cron requests are marked by a header that App Engine strips from
+// external requests.
+func (appenginePlatform) isTask(r *http.Request) bool {
+	return r.Header.Get("X-Appengine-Cron") == "true"
+}
+
+// app.yaml makes /_ah/mail/ admin-only, so only the mail service (or an
+// admin) gets this far.
+func (appenginePlatform) isMail(r *http.Request) bool {
+	return true
+}
+
+// Notifier that sends mail and XMPP messages with the App Engine services.
+type appengineNotifier struct{}
+
+func (appengineNotifier) SendMail(r *http.Request, msg *Message) error {
+	return mail.Send(appengine.NewContext(r), &mail.Message{
+		Sender:  config.Sender,
+		To:      msg.To,
+		ReplyTo: msg.ReplyTo,
+		Subject: msg.Subject,
+		Body:    msg.Body,
+	})
+}
+
+func (appengineNotifier) SendChat(r *http.Request, to, text string) error {
+	msg := &xmpp.Message{To: []string{to}, Body: text}
+	return msg.Send(appengine.NewContext(r))
+}
+
+func (appengineNotifier) CanChat() bool {
+	return true
+}
+
+func (appenginePlatform) errorf(r *http.Request, format string, args ...interface{}) {
+	appengine.NewContext(r).Errorf(format, args...)
+}
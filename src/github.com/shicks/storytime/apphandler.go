@@ -4,11 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"path"
 	"strings"
-
-	"appengine"
-	"appengine/user"
 )
 
 type appError struct {
@@ -22,34 +20,45 @@ func err(text string) *appError {
 }
 
 type request struct {
-	req     *http.Request
-	reqCtx  *appengine.Context
-	reqUser *user.User
+	req *http.Request
+	// The logged-in user, once they've been looked up.  It's a pointer
+	// so that every copy of the request shares it.
+	auth *requestUser
 }
 
-func (r request) ctx() appengine.Context {
-	if r.reqCtx == nil {
-		c := appengine.NewContext(r.req)
-		r.reqCtx = &c
-	}
-	return *r.reqCtx
+type requestUser struct {
+	user    *User
+	checked bool
 }
 
-func (r request) user() (*user.User, string) {
-	if r.reqUser == nil {
-		r.reqUser = user.Current(r.ctx())
-		if r.reqUser == nil {
-			url, err := user.LoginURL(r.ctx(), r.req.URL.String())
-			if err != nil {
-				panic(err)
-			}
-			return nil, url
+func newRequest(r *http.Request) request {
+	return request{r, &requestUser{}}
+}
+
+// Returns the StoryStore backing this request.
+func (r request) store() StoryStore {
+	return host.store(r.req)
+}
+
+// Returns the logged-in user, whether they logged in with an emailed
+// link or the platform's accounts, or else nil and a login URL.  A
+// session takes precedence, so that revoking it always signs the
+// browser out of storytime.
+func (r request) user() (*User, string) {
+	if !r.auth.checked {
+		r.auth.checked = true
+		r.auth.user = sessionUser(r)
+		if r.auth.user == nil {
+			r.auth.user = host.user(r.req)
 		}
 	}
-	return r.reqUser, ""
+	if r.auth.user == nil {
+		return nil, "/signin?continue=" + url.QueryEscape(r.req.URL.RequestURI())
+	}
+	return r.auth.user, ""
 }
 
-func (r request) userRequired() *user.User {
+func (r request) userRequired() *User {
 	u, url := r.user()
 	if u == nil {
 		panic(redirect(url))
@@ -57,10 +66,16 @@ func (r request) userRequired() *user.User {
 	return u
 }
 
+// Logs an error for this request.
+func (r request) errorf(format string, args ...interface{}) {
+	host.errorf(r.req, format, args...)
+}
+
 // Pattern is a string like "/story/:storyId/:partId"
 func (r request) matchPath(pattern string) *map[string]string {
 	pattern = path.Clean(pattern)
-	url := path.Clean(r.req.URL.String())
+	// Note: the query string isn't part of the path.
+	url := path.Clean(r.req.URL.Path)
 	patternSplit := strings.Split(pattern, "/")
 	if patternSplit[0] != "" {
 		panic(errors.New("Bad pattern"))
@@ -113,6 +128,17 @@ func (r redirectResponse) Write(w http.ResponseWriter) {
 	w.WriteHeader(r.code)
 }
 
+// Response that sets a cookie before redirecting.
+type cookieRedirect struct {
+	cookie *http.Cookie
+	redirectResponse
+}
+
+func (r cookieRedirect) Write(w http.ResponseWriter) {
+	http.SetCookie(w, r.cookie)
+	r.redirectResponse.Write(w)
+}
+
 // Response that returns an error to the user
 type errorResponse struct {
 	code    int
@@ -127,7 +153,20 @@ var notFound = errorResponse{404, "Not Found"}
 
 type appHandler func(request) response
 
+// Handler for requests that don't come from our own forms (inbound mail
+// and scheduled tasks), so can't carry a CSRF token.
+type uncheckedHandler appHandler
+
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fn.serve(w, r, true)
+}
+
+func (fn uncheckedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	appHandler(fn).serve(w, r, false)
+}
+
+// Runs the handler, checking the CSRF token of POSTs if checkCSRF is set.
+func (fn appHandler) serve(w http.ResponseWriter, r *http.Request, checkCSRF bool) {
 	defer func() {
 		if e := recover(); e != nil {
 			// We can use panic to prematurely exit a function
@@ -136,17 +175,25 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			// More traditional recovery involves some logging
-			c := appengine.NewContext(r)
 			switch e := e.(type) {
-			case appError:
-				c.Errorf("%v", e.Error)
+			case *appError:
+				host.errorf(r, "%v", e.Error)
 				http.Error(w, e.Message, e.Code)
 			default:
-				c.Errorf("%v", e)
+				host.errorf(r, "%v", e)
 				http.Error(w, fmt.Sprintf("%v", e), http.StatusInternalServerError)
 			}
 		}
 	}()
-	resp := fn(request{req: r})
+	req := newRequest(r)
+	token := csrfToken(w, req)
+	if checkCSRF && r.Method == "POST" && !validCSRF(req) {
+		panic(errBadCSRF)
+	}
+	resp := fn(req)
+	if t, ok := resp.(templateResponse); ok {
+		t.csrf = token
+		resp = t
+	}
 	resp.Write(w)
 }
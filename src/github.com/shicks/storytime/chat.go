@@ -0,0 +1,53 @@
+package storytime
+
+// Turn messages over chat, for users who'd rather not get them by email.
+// How they're sent is up to the Notifier: App Engine's uses its XMPP
+// service, and WithMatrixChat posts them to Matrix rooms.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Returns the address to send the user's turn messages to by chat, or
+// "" if they want them by email (or chat can't be sent, in which case
+// they get email instead).
+func chatAddress(s StoryStore, email string) string {
+	if !config.Notifier.CanChat() {
+		return ""
+	}
+	if info := s.GetUserInfo(email); info != nil && info.Notify == notifyChat {
+		return info.Chat
+	}
+	return ""
+}
+
+// Posts a text message to a Matrix room, through the given homeserver.
+func sendMatrix(client *http.Client, server, token, room, text string) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": text})
+	if err != nil {
+		return err
+	}
+	// The transaction ID only needs to be unique, so that retries of the
+	// same request aren't posted twice.
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		server, url.PathEscape(room), randomString(16))
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Chat server returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+// The command-line client, which plays turns through the JSON API.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Client subcommands, by name.  Each returns the exit status.
+var clientCommands = map[string]func(args []string) int{
+	"list":  listTurns,
+	"write": writeTurn,
+}
+
+const clientUsage = `
+  storytime list            List the stories waiting for you to write.
+  storytime write [STORY]   Write your part of STORY (or the oldest one waiting).
+
+The server and your API token (from its settings page) are read from
+$STORYTIME_URL and $STORYTIME_TOKEN.
+`
+
+// The parts of the API's responses that the client uses.
+type turn struct {
+	Story struct {
+		Id        string   `json:"id"`
+		Authors   []string `json:"authors"`
+		Words     int      `json:"words"`
+		WordsLeft int      `json:"wordsLeft"`
+		EndRule   string   `json:"endRule"`
+		Ending    string   `json:"ending"`
+	} `json:"story"`
+	PartId          string    `json:"partId"`
+	LastVisible     string    `json:"lastVisible"`
+	Expires         time.Time `json:"expires"`
+	LengthUnit      string    `json:"lengthUnit"`
+	MinLength       int       `json:"minLength"`
+	MaxLength       int       `json:"maxLength"`
+	WordQuota       int       `json:"wordQuota"`
+	Closing         bool      `json:"closing"`
+	ClosingMaxWords int       `json:"closingMaxWords"`
+	VisibleMode     string    `json:"visibleMode"`
+	VisibleWords    int       `json:"visibleWords"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Talks to the server's /api/v1/.
+type client struct {
+	baseURL string
+	token   string
+}
+
+func newClient() (*client, error) {
+	c := &client{strings.TrimSuffix(os.Getenv("STORYTIME_URL"), "/"), os.Getenv("STORYTIME_TOKEN")}
+	if c.baseURL == "" {
+		c.baseURL = "http://localhost:8080"
+	}
+	if c.token == "" {
+		return nil, errors.New("$STORYTIME_TOKEN is not set; create a token on the server's settings page")
+	}
+	return c, nil
+}
+
+// Makes an API call, decoding the response into result.
+func (c *client) call(method, path string, body, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/api/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error.Message != "" {
+			return errors.New(e.Error.Message)
+		}
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *client) turns() ([]turn, error) {
+	var turns []turn
+	err := c.call("GET", "/turns", nil, &turns)
+	return turns, err
+}
+
+// Lists the stories waiting on the user.
+func listTurns(args []string) int {
+	c, err := newClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	turns, err := c.turns()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't list stories:", err)
+		return 1
+	}
+	if len(turns) == 0 {
+		fmt.Println("No stories are waiting for you.")
+	}
+	for _, t := range turns {
+		fmt.Printf("%s  %s, with %s\n", t.Story.Id, progress(t), strings.Join(t.Story.Authors, ", "))
+		if t.LastVisible != "" {
+			fmt.Printf("    > %s\n", t.LastVisible)
+		} else {
+			fmt.Println("    (You're writing the beginning.)")
+		}
+	}
+	return 0
+}
+
+// Lets the user write their part in $EDITOR, checks it the same way as
+// the continue page does, and submits it.
+func writeTurn(args []string) int {
+	c, err := newClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	turns, err := c.turns()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't list stories:", err)
+		return 1
+	}
+	var t *turn
+	for i := range turns {
+		if len(args) == 0 || turns[i].Story.Id == args[0] {
+			t = &turns[i]
+			break
+		}
+	}
+	if t == nil {
+		fmt.Fprintln(os.Stderr, "No matching story is waiting for you.")
+		return 1
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	text := ""
+	for {
+		if text, err = edit(*t, text); err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't run editor:", err)
+			return 1
+		}
+		if text == "" {
+			fmt.Println("Nothing written; giving up.")
+			return 1
+		}
+		problem := describe(*t, text)
+		if problem == "" && confirm(in, "Submit this part? [y/N] ", false) {
+			break
+		} else if problem != "" {
+			fmt.Println(problem)
+		}
+		if !confirm(in, "Edit it again? [Y/n] ", true) {
+			return 1
+		}
+	}
+	if err := c.call("POST", "/stories/"+t.Story.Id+"/parts",
+		map[string]string{"partId": t.PartId, "text": text}, &json.RawMessage{}); err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't submit your part:", err)
+		return 1
+	}
+	fmt.Println("Your part was saved.")
+	return 0
+}
+
+// Describes how far along the story is.
+func progress(t turn) string {
+	if t.Story.EndRule != "" {
+		return strings.TrimSuffix(t.Story.Ending, ".")
+	}
+	return fmt.Sprintf("%d of %d words left", t.Story.WordsLeft, t.Story.Words)
+}
+
+// Prints what will happen to the part, as the continue page does, and
+// returns why it can't be submitted, or "".
+func describe(t turn, text string) string {
+	unit, length := "characters", len([]rune(text))
+	if t.LengthUnit == "words" {
+		unit, length = "words", len(strings.Fields(text))
+	}
+	if length > t.MaxLength {
+		return fmt.Sprintf("Your part is %d %s long, but the maximum is %d.", length, unit, t.MaxLength)
+	} else if length < t.MinLength {
+		return fmt.Sprintf("Your part is %d %s long, but the minimum is %d.", length, unit, t.MinLength)
+	} else if words := len(strings.Fields(text)); t.ClosingMaxWords > 0 && words > t.ClosingMaxWords {
+		return fmt.Sprintf("Yours is the last part, and it's %d words long, but the story can only run to %d more.",
+			words, t.ClosingMaxWords)
+	}
+	if t.Closing {
+		fmt.Println("This part will end the story.")
+	} else if t.Story.EndRule != "" {
+		fmt.Println(t.Story.Ending)
+	} else if left := t.Story.WordsLeft - len(strings.Fields(text)); left > 0 {
+		fmt.Printf("%d words will be left in the story.\n", left)
+	} else {
+		fmt.Println("This part will end the story.")
+	}
+	fmt.Printf("The next author will see:\n    > %s\n", visiblePart(t, text))
+	return ""
+}
+
+// Describes the limits on the part's length.
+func lengthLimits(t turn) string {
+	unit := "characters"
+	if t.LengthUnit == "words" {
+		unit = "words"
+	}
+	limits := fmt.Sprintf("at most %d %s", t.MaxLength, unit)
+	if t.MinLength > 0 {
+		limits = fmt.Sprintf("%d to %d %s", t.MinLength, t.MaxLength, unit)
+	}
+	if t.WordQuota > 0 {
+		limits += fmt.Sprintf(", ideally about %d words", t.WordQuota)
+	}
+	return limits
+}
+
+// Matches the end of a sentence, as the server does.
+var sentenceEnd = regexp.MustCompile(`[.!?]+["'\x{201D}\x{2019})\]]*\s+`)
+
+// Returns what the next author will see of the text, as storytime.js does.
+func visiblePart(t turn, text string) string {
+	switch t.VisibleMode {
+	case "sentence":
+		all := strings.Join(strings.Fields(text), " ")
+		if ends := sentenceEnd.FindAllStringIndex(all, -1); len(ends) > 0 {
+			return all[ends[len(ends)-1][1]:]
+		}
+		return all
+	case "line":
+		return lastWords(text, len(text))
+	}
+	return lastWords(text, t.VisibleWords)
+}
+
+// Describes how much of a part the next author sees.
+func visibleDescription(t turn) string {
+	switch t.VisibleMode {
+	case "sentence":
+		return "your last sentence"
+	case "line":
+		return "your last line"
+	}
+	return fmt.Sprintf("the last %d words of your last line", t.VisibleWords)
+}
+
+// Returns the last count words of the last non-blank line.
+func lastWords(text string, count int) string {
+	lines := strings.Split(text, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) != "" {
+			text = lines[i]
+			break
+		}
+	}
+	words := strings.Fields(text)
+	if len(words) > count {
+		words = words[len(words)-count:]
+	}
+	return strings.Join(words, " ")
+}
+
+// Opens $EDITOR on the draft, with instructions in comments, and
+// returns what the user wrote.
+func edit(t turn, draft string) (string, error) {
+	f, err := ioutil.TempFile("", "storytime-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "%s\n\n", draft)
+	fmt.Fprintf(f, "# Story %s: %s.\n", t.Story.Id, progress(t))
+	if t.Closing {
+		fmt.Fprintln(f, "# Yours is the last part of the story, so please bring it to a close.")
+	}
+	if t.LastVisible != "" {
+		fmt.Fprintf(f, "# The previous author wrote:\n#   > %s\n", t.LastVisible)
+	} else {
+		fmt.Fprintln(f, "# You're writing the beginning of the story.")
+	}
+	fmt.Fprintf(f, "# Write your part above (%s).  Lines starting with\n", lengthLimits(t))
+	fmt.Fprintf(f, "# '#' are ignored.  The next author only sees %s.\n", visibleDescription(t))
+	f.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// Asks a yes/no question, returning def for an empty answer.
+func confirm(in *bufio.Reader, question string, def bool) bool {
+	fmt.Print(question)
+	answer, _ := in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "":
+		return def
+	case "y", "yes":
+		return true
+	}
+	return false
+}
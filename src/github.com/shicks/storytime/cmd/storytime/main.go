@@ -0,0 +1,101 @@
+//go:build !appengine
+// +build !appengine
+
+// Command storytime serves the storytime game with net/http, outside of
+// the App Engine runtime.  Given a client subcommand (see clientUsage),
+// it instead plays turns against a server from the terminal.
+//
+// The -db store uses the SQLite driver checked in under
+// src/github.com/mattn/go-sqlite3 (v1.14.33), which is cgo: building
+// needs CGO_ENABLED=1 and a C compiler.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/shicks/storytime"
+)
+
+var (
+	listen    = flag.String("listen", ":8080", "Address to listen on")
+	baseUrl   = flag.String("base_url", "http://localhost:8080", "Public URL of the server, used in emailed links")
+	sender    = flag.String("sender", "Storytime <storytime@localhost>", "Address notification emails are sent from")
+	replyTo   = flag.String("reply_domain", "", "Domain whose mail is piped to /_ah/mail/, to enable replying by email")
+	mailKey   = flag.String("mail_secret", "", "Secret the mail gateway sends in the X-Storytime-Mail-Secret header; replies are refused without one")
+	resources = flag.String("resources", "src/github.com/shicks/storytime", "Directory containing template.html, storytime.css and storytime.js")
+	admins    = flag.String("admins", "", "Comma-separated emails allowed to use the admin handlers")
+	tasks     = flag.Duration("task_interval", 15*time.Minute, "How often to remind and skip idle authors")
+	deliver   = flag.Duration("delivery_interval", 30*time.Second, "How often to send queued messages and webhooks")
+	smtpAddr  = flag.String("smtp", "", "SMTP server (host:port) to send mail through; if empty, messages are written to -mail_file")
+	smtpUser  = flag.String("smtp_user", "", "Username for the SMTP server, if it needs one ($STORYTIME_SMTP_PASSWORD is the password)")
+	mailFile  = flag.String("mail_file", "", "File to append messages to instead of sending them; if empty, stdout")
+	chatURL   = flag.String("chat_server", "", "Matrix homeserver URL to send chat messages through")
+	chatToken = flag.String("chat_token", "", "Access token of the account that sends chat messages")
+	dbFile    = flag.String("db", "", "SQLite database file; if empty, stories are only kept in memory")
+	devLogin  = flag.Bool("dev_login", false, "Serve /login, which signs anyone in as any address (for development only)")
+)
+
+// Returns the Notifier chosen by the flags.
+func notifier() storytime.Notifier {
+	var n storytime.Notifier
+	if *smtpAddr != "" {
+		n = storytime.NewSMTPNotifier(*smtpAddr, *smtpUser, os.Getenv("STORYTIME_SMTP_PASSWORD"))
+	} else if *mailFile != "" {
+		f, err := os.OpenFile(*mailFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("Could not open mail file %s: %v", *mailFile, err)
+		}
+		n = storytime.NewFileNotifier(f)
+	} else {
+		n = storytime.NewFileNotifier(os.Stdout)
+	}
+	if *chatURL != "" {
+		n = storytime.WithMatrixChat(n, *chatURL, *chatToken)
+	}
+	return n
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := clientCommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s (as a server):\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nAs a client:%s", clientUsage)
+	}
+	flag.Parse()
+	cfg := storytime.Config{
+		BaseURL:     *baseUrl,
+		Sender:      *sender,
+		ReplyDomain: *replyTo,
+		MailSecret:  *mailKey,
+		ResourceDir: *resources,
+		Notifier:    notifier(),
+	}
+	var adminList []string
+	if *admins != "" {
+		adminList = strings.Split(*admins, ",")
+	}
+	store := storytime.NewMemoryStore()
+	if *dbFile != "" {
+		var err error
+		if store, err = storytime.OpenSQLStore("sqlite3", *dbFile); err != nil {
+			log.Fatalf("Could not open database %s: %v", *dbFile, err)
+		}
+	}
+	handler := storytime.NewStandaloneHandler(cfg, store, adminList, *devLogin)
+	go storytime.RunScheduledTasks(*tasks)
+	go storytime.RunDeliveryTasks(*deliver)
+	log.Printf("Serving storytime on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, handler))
+}
@@ -0,0 +1,59 @@
+package storytime
+
+// Protection against cross-site request forgery.  Every form we serve
+// includes a token (via the csrfField template function) signed from the
+// browser's session ID, so that it changes whenever the user signs in or
+// out.  Browsers without a session, such as on the sign-in page, get a
+// random cookie to sign instead.  appHandler rejects POSTs whose token
+// doesn't match, since other sites can make the browser send our
+// cookies but can't read them.
+
+import (
+	"html/template"
+	"net/http"
+)
+
+const (
+	csrfCookie = "storytime-csrf"
+	csrfField  = "csrf"
+)
+
+// Returns the request's CSRF token.  Without a session, it sets a new
+// cookie for the token if the browser doesn't have one yet.
+func csrfToken(w http.ResponseWriter, r request) string {
+	if id := sessionId(r); id != "" {
+		return sign(r.store(), "csrf", "session", id)
+	}
+	c, err := r.req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		c = &http.Cookie{Name: csrfCookie, Value: randomString(32), Path: "/", HttpOnly: true}
+		http.SetCookie(w, c)
+	}
+	return sign(r.store(), "csrf", "browser", c.Value)
+}
+
+// Returns whether the posted form carries a valid token for the
+// browser's session, or its cookie if it has no session.
+func validCSRF(r request) bool {
+	token := r.req.PostFormValue(csrfField)
+	if id := sessionId(r); id != "" {
+		return validSignature(r.store(), token, "csrf", "session", id)
+	}
+	c, err := r.req.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return validSignature(r.store(), token, "csrf", "browser", c.Value)
+}
+
+// Returns the csrfField template function, emitting a hidden field with
+// the given token.
+func csrfFieldFunc(token string) func() template.HTML {
+	field := `<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `">`
+	return func() template.HTML {
+		return template.HTML(field)
+	}
+}
+
+var errBadCSRF = &errorPage{Code: http.StatusForbidden,
+	Message: "This form has expired.  Please go back, reload the page and try again."}
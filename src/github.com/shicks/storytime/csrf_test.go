@@ -0,0 +1,86 @@
+package storytime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Returns the cookie named name that w set, or nil.
+func setCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestCSRFWithoutSession(t *testing.T) {
+	setUpTest(nil)
+	w := httptest.NewRecorder()
+	token := csrfToken(w, newTestRequest("GET", "/signin", nil))
+	cookie := setCookie(w, csrfCookie)
+	if cookie == nil {
+		t.Fatalf("csrfToken didn't set a %s cookie", csrfCookie)
+	}
+
+	w = httptest.NewRecorder()
+	if again := csrfToken(w, newTestRequest("GET", "/signin", nil, cookie)); again != token {
+		t.Errorf("token changed from %q to %q with the same cookie", token, again)
+	}
+	if setCookie(w, csrfCookie) != nil {
+		t.Errorf("csrfToken set a new cookie when the browser had one")
+	}
+
+	other := &http.Cookie{Name: csrfCookie, Value: "other"}
+	tests := []struct {
+		name    string
+		token   string
+		cookies []*http.Cookie
+		want    bool
+	}{
+		{"valid", token, []*http.Cookie{cookie}, true},
+		{"no token", "", []*http.Cookie{cookie}, false},
+		{"no cookie", token, nil, false},
+		{"other cookie", token, []*http.Cookie{other}, false},
+	}
+	for _, test := range tests {
+		r := newTestRequest("POST", "/signin", url.Values{csrfField: {test.token}}, test.cookies...)
+		if got := validCSRF(r); got != test.want {
+			t.Errorf("%s: validCSRF = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCSRFWithSession(t *testing.T) {
+	setUpTest(nil)
+	w := httptest.NewRecorder()
+	browser := newTestRequest("GET", "/signin", nil)
+	before := csrfToken(w, browser)
+	cookie := setCookie(w, csrfCookie)
+	session := newSession(browser, "a@x.com")
+
+	w = httptest.NewRecorder()
+	after := csrfToken(w, newTestRequest("GET", "/", nil, cookie, session))
+	if after == before {
+		t.Errorf("token didn't change on signing in")
+	}
+	if setCookie(w, csrfCookie) != nil {
+		t.Errorf("csrfToken set a cookie for a browser with a session")
+	}
+	if !validCSRF(newTestRequest("POST", "/", url.Values{csrfField: {after}}, cookie, session)) {
+		t.Errorf("session token isn't valid")
+	}
+	if validCSRF(newTestRequest("POST", "/", url.Values{csrfField: {before}}, cookie, session)) {
+		t.Errorf("token from before signing in is still valid")
+	}
+	if validCSRF(newTestRequest("POST", "/", url.Values{csrfField: {after}}, cookie)) {
+		t.Errorf("session token is still valid after signing out")
+	}
+	other := newSession(browser, "a@x.com")
+	if validCSRF(newTestRequest("POST", "/", url.Values{csrfField: {after}}, cookie, other)) {
+		t.Errorf("token is valid for another session")
+	}
+}
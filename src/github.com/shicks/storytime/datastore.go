@@ -1,30 +1,57 @@
+//go:build appengine
+// +build appengine
+
 package storytime
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"fmt"
 	"net/http"
-	"net/mail"
 	"sort"
-	"strings"
 	"time"
 
 	"appengine"
 	"appengine/datastore"
+	"appengine/memcache"
 )
 
+// StoryStore backed by the App Engine datastore, with user names
+// cached in memcache.
+type datastoreStore struct {
+	c appengine.Context
+}
+
+func newDatastoreStore(c appengine.Context) StoryStore {
+	return datastoreStore{c}
+}
+
+// Runs the query, returning up to limit (or all, if limit < 0) of the
+// stories that match the filter.  Archived and deleted stories are
+// filtered here rather than in the query, so that existing entities
+// without those properties still match.
+func (s datastoreStore) runFiltered(q *datastore.Query, limit int, filter func(Story) bool) []Story {
+	stories := make([]Story, 0)
+	for t := q.Run(s.c); limit < 0 || len(stories) < limit; {
+		var story Story
+		_, err := t.Next(&story)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			panic(&appError{err, "Failed to fetch stories", 500})
+		}
+		if filter(story) {
+			stories = append(stories, story)
+		}
+	}
+	return stories
+}
+
 // Retrieves the current story for the given user.
-func currentStory(c appengine.Context, author string) *Story {
+func (s datastoreStore) CurrentStory(author string) *Story {
 	q := datastore.NewQuery("Story").
 		Filter("Complete =", false).
 		Filter("NextAuthor =", author).
-		Order("Modified"). // TODO(sdh): what about kicks/skips? - can that mis-sequence?
-		Limit(1)           // TODO(sdh): don't limit so we can count?
-	var result []Story
-	if _, err := q.GetAll(c, &result); err != nil {
-		panic(&appError{err, "Failed to fetch current story", 500})
-	}
+		Order("Modified") // Note: skips bump Modified, queueing the story behind the new author's others.
+	// TODO(sdh): don't limit so we can count?
+	result := s.runFiltered(q, 1, Story.Active)
 	if len(result) > 0 {
 		return &result[0]
 	}
@@ -32,112 +59,101 @@ func currentStory(c appengine.Context, author string) *Story {
 }
 
 // Retrieves all the in-progress stories for the given author.
-func inProgressStories(c appengine.Context, author string) []InProgressStory {
-
+func (s datastoreStore) InProgressStories(author string) []Story {
 	q := datastore.NewQuery("StoryAuthor").
 		Filter("Author =", author).
 		KeysOnly()
 
-	keys, err := q.GetAll(c, nil)
+	keys, err := q.GetAll(s.c, nil)
 	if err != nil {
 		panic(&appError{err, "Failed to fetch in-progress story authors", 500})
 	}
 
 	storyKeys := make([]*datastore.Key, len(keys))
-
 	for i, key := range keys {
 		storyKeys[i] = key.Parent()
 	}
 	stories := make([]Story, len(keys))
-	if err := datastore.GetMulti(c, storyKeys, stories); err != nil {
+	if err := datastore.GetMulti(s.c, storyKeys, stories); err != nil {
 		panic(&appError{err, "Failed to fetch in-progress stories", 500})
 	}
 	sort.Sort(byTime(stories))
-
-	inProgress := make([]InProgressStory, len(keys))
-	for i, story := range stories {
-		inProgress[i] = story.InProgress(author)
-		inProgress[i].RewriteAuthors(nameFunc(c))
-	}
-
-	return inProgress
+	return stories
 }
 
-// ByTime implements sort.Interface for []Story based on the Modified field (descending).
-type byTime []Story
-
-func (a byTime) Len() int           { return len(a) }
-func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byTime) Less(i, j int) bool { return a[i].Modified.Before(a[j].Modified) }
-
 // Retrieves a story by ID.
-func fetchStory(c appengine.Context, id string) *Story {
-	k := datastore.NewKey(c, "Story", id, 0, nil)
+func (s datastoreStore) FetchStory(id string) *Story {
+	k := datastore.NewKey(s.c, "Story", id, 0, nil)
 	var story = new(Story)
-	if err := datastore.Get(c, k, story); err != nil {
+	if err := datastore.Get(s.c, k, story); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
 		panic(&appError{err, "Failed to fetch story", 500})
 	}
 	return story
 }
 
-// TODO(sdh): allow logged-in (or via email) users to set their name
-//    - alternately, take it from the "From" line?
-//    - memcache for caching email-to-name?
-//    - how to inject the cache? (may not need to - just use context)
 // TODO(sdh): support pagination and per-user?
 // TODO(sdh): search service for fulltext story search
-func completedStories(c appengine.Context, limit int, olderThan time.Time) []Story {
+func (s datastoreStore) CompletedStories(limit int, olderThan time.Time) []Story {
 	q := datastore.NewQuery("Story").
 		Filter("Complete =", true).
 		Order("-Modified").
-		Filter("Modified <", olderThan).
-		Limit(limit)
-	var stories []Story
-	if _, err := q.GetAll(c, &stories); err != nil {
-		panic(err)
-	}
-	return stories
+		Filter("Modified <", olderThan)
+	return s.runFiltered(q, limit, func(story Story) bool {
+		return story.Deleted.IsZero()
+	})
 }
 
-// Generates a random string of lowercase letters and numbers of the given length.
-func randomString(l int) string {
-	b := make([]byte, 2*l)
-	rand.Read(b)
-	s := base64.StdEncoding.EncodeToString(b)
-	s = strings.Replace(s, "+", "", -1)
-	s = strings.Replace(s, "/", "", -1)
-	s = strings.Replace(s, "=", "", -1)
-	s = strings.ToLower(s)
-	if len(s) > l {
-		s = s[:l]
+func (s datastoreStore) CompletedStoriesBy(author string, limit int) []Story {
+	q := datastore.NewQuery("Story").
+		Filter("Authors =", author).
+		Filter("Complete =", true).
+		Order("-Modified")
+	return s.runFiltered(q, limit, func(story Story) bool {
+		return story.Deleted.IsZero()
+	})
+}
+
+func (s datastoreStore) IdleStories(modifiedBefore time.Time) []Story {
+	q := datastore.NewQuery("Story").
+		Filter("Complete =", false).
+		Filter("Modified <", modifiedBefore)
+	return s.runFiltered(q, -1, Story.Active)
+}
+
+func (s datastoreStore) DeletedStories(deletedBefore time.Time) []Story {
+	q := datastore.NewQuery("Story").
+		Filter("Deleted >", time.Time{}).
+		Filter("Deleted <", deletedBefore)
+	var stories []Story
+	if _, err := q.GetAll(s.c, &stories); err != nil {
+		panic(&appError{err, "Failed to fetch deleted stories", 500})
 	}
-	// TODO(sdh): if the length is too short, add more.
-	return s
+	return stories
 }
 
-func putShortKey(c appengine.Context, kind string, story *Story, parent *datastore.Key, minLength int) (*datastore.Key, error) {
-	// Pick a random ID and then find all 2+ character substrings
-	s := randomString(32)
-	var result *Story
-	var key *datastore.Key
+// Saves the story under the shortest unused prefix (of at least minLength
+// characters) of a random ID, along with all its StoryAuthor entities.
+// The queued messages and deliveries are in the story's entity group.
+func (s datastoreStore) PutNewStory(story *Story, minLength int, queue func(Story) Queued) {
+	// Pick a random ID and then try successively longer prefixes
+	id := randomString(32)
 	var e error
-	for i := minLength; i < len(s); i++ {
-		e = datastore.RunInTransaction(c, func(c appengine.Context) error {
-			result = nil
-			key = datastore.NewKey(c, kind, s[:i], 0, parent)
-			story.Id = s[:i]
-			if err := datastore.Get(c, key, result); err != nil && err != datastore.ErrNoSuchEntity {
+	for i := minLength; i < len(id); i++ {
+		story.Id = id[:i]
+		queued := queue(*story)
+		e = datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+			key := datastore.NewKey(c, "Story", story.Id, 0, nil)
+			if err := datastore.Get(c, key, new(Story)); err == nil {
+				return errKeyTaken
+			} else if err != datastore.ErrNoSuchEntity {
 				return err
 			}
-			if result != nil {
-				i++
-				return datastore.ErrConcurrentTransaction
-			}
 			if _, err := datastore.Put(c, key, story); err != nil {
 				return err
 			}
-			// Also store all the StoryAuthor entities (Note: we could re-abstract this to HasId
-			// by adding a method finalize() but it would pull datastore details into story.go
+			// Also store all the StoryAuthor entities
 			authorKeys := make([]*datastore.Key, 0, len(story.Authors))
 			authorEntities := make([]StoryAuthor, 0, len(story.Authors))
 			for _, author := range story.Authors {
@@ -147,150 +163,529 @@ func putShortKey(c appengine.Context, kind string, story *Story, parent *datasto
 			if _, err := datastore.PutMulti(c, authorKeys, authorEntities); err != nil {
 				return err
 			}
-			return nil
+			return putQueued(c, queued)
 		}, nil)
 		if e == nil {
-			return key, nil
+			return
 		}
 	}
-	return nil, e
-}
-
-// Makes a new story and saves it to the datastore.
-// Returns the ID.
-func newStory(r request, authors []*mail.Address, words int) Story {
-	u, _ := r.user()
-	if u == nil {
-		panic(fmt.Errorf("Must be logged in to start a new story."))
-	}
-	addrs := make([]string, len(authors))
-	parts := make([]StoryPart, 0)
-	found := false
-	for i, author := range authors {
-		if author.Name != "" {
-			putNameForEmailIfAbsent(r.ctx(), author.Name, author.Address)
-		}
-		addrs[i] = author.Address
-		found = found || author.Address == u.Email
-	}
-	if !found {
-		panic(errorResponse{400, "Error: New stories must include yourself as an author."})
-	}
-	now := time.Now()
-	story := &Story{
-		Created:    now,
-		Creator:    u.Email,
-		NextId:     randomString(8),
-		NextAuthor: addrs[0],
-		Modified:   now,
-		Complete:   false,
-		Parts:      parts,
-		Authors:    addrs,
-		Words:      words,
-	}
-	key, err := putShortKey(r.ctx(), "Story", story, nil, 3)
-	if err != nil {
-		panic(&appError{err, "Failed to put story in datastore", http.StatusInternalServerError})
-	}
-	if story.Id != key.StringID() {
-		panic(fmt.Errorf("Expected story.Id == key.StringID(): %s vs %s", story.Id, key.StringID()))
-	}
-	return *story
+	story.Id = ""
+	panic(&appError{e, "Failed to put story in datastore", http.StatusInternalServerError})
 }
 
-// Returns the next author in the cycle, panics if the
-// current author is not found.
-func findNextAuthor(authors []string, author string) string {
-	for i, a := range authors {
-		if a == author {
-			return authors[(i+1)%len(authors)]
-		}
-	}
-	panic(fmt.Errorf("Could not find author %s in author list %s", author, authors))
-}
-
-// Makes a new story and saves it to the datastore.  Panics in case of
-// an error.
-func savePart(c appengine.Context, story *Story, text string) {
-	maxVisible := 16
-	var part StoryPart
-	now := time.Now()
-
-	part.Id = story.NextId
-	story.NextId = randomString(8)
-	part.Author = story.NextAuthor
-	story.NextAuthor = findNextAuthor(story.Authors, story.NextAuthor)
-	part.Written = now
-	story.Modified = now
-	// Sanitize the text
-	lines := SplitterOnAny("\n\r").TrimResults().OmitEmpty().SplitToList(text)
-	if len(lines) < 1 {
-		panic(fmt.Errorf("No text: %s", text))
-	}
-	hidden := strings.Join(lines[:len(lines)-1], " ")
-	visible := lines[len(lines)-1]
-	// Make sure we don't have too much visible
-	wordSplitter := SplitterOn(" ").TrimResults().OmitEmpty()
-	words := wordSplitter.SplitToList(visible)
-	if len(words) > maxVisible {
-		lastWord := len(words) - maxVisible
-		hidden = hidden + " " + strings.Join(words[:lastWord], " ")
-		visible = strings.Join(words[lastWord:], " ")
-	}
-	part.Hidden = strings.Join(wordSplitter.SplitToList(hidden), " ")
-	part.Visible = visible
-	story.Parts = append(story.Parts, part)
-	if story.WordCount() >= story.Words {
-		story.Complete = true
-	}
-	e := datastore.RunInTransaction(c, func(c appengine.Context) error {
+// Saves the story, checking that the part was not written concurrently.
+func (s datastoreStore) UpdateStory(story *Story, partId string, queued Queued) {
+	e := datastore.RunInTransaction(s.c, func(c appengine.Context) error {
 		existing := new(Story)
 		key := datastore.NewKey(c, "Story", story.Id, 0, nil)
 		if err := datastore.Get(c, key, existing); err != nil {
 			return err
 		}
-		if existing.NextId != part.Id {
-			panic(fmt.Errorf("Part was written concurrently."))
+		if existing.NextId != partId {
+			return errConcurrentPart
 		}
 		if _, err := datastore.Put(c, key, story); err != nil {
 			return err
 		}
-		if story.Complete {
-			// We need to delete all the author keys
-			q := datastore.NewQuery("StoryAuthor").
-				Ancestor(key).
-				KeysOnly()
-			authorKeys, err := q.GetAll(c, nil)
-			if err != nil {
-				return err
+		if err := putQueued(c, queued); err != nil {
+			return err
+		}
+		// Bring the StoryAuthor keys in line with the authors (deleting
+		// all of them once the story is no longer active).
+		q := datastore.NewQuery("StoryAuthor").
+			Ancestor(key).
+			KeysOnly()
+		authorKeys, err := q.GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		indexed := make(map[string]bool)
+		staleKeys := make([]*datastore.Key, 0)
+		for _, k := range authorKeys {
+			if !story.Active() || !story.HasAuthor(k.StringID()) {
+				staleKeys = append(staleKeys, k)
 			}
-			if err := datastore.DeleteMulti(c, authorKeys); err != nil {
-				return err
+			indexed[k.StringID()] = true
+		}
+		if err := datastore.DeleteMulti(c, staleKeys); err != nil {
+			return err
+		}
+		if !story.Active() {
+			return nil
+		}
+		newKeys := make([]*datastore.Key, 0)
+		newEntities := make([]StoryAuthor, 0)
+		for _, author := range story.Authors {
+			if !indexed[author] {
+				newKeys = append(newKeys, datastore.NewKey(c, "StoryAuthor", author, 0, key))
+				newEntities = append(newEntities, StoryAuthor{author, story.Id})
 			}
 		}
+		if _, err := datastore.PutMulti(c, newKeys, newEntities); err != nil {
+			return err
+		}
 		return nil
 	}, nil)
-	if e != nil {
+	if e == errConcurrentPart {
+		panic(&appError{e, e.Error(), http.StatusConflict})
+	} else if e != nil {
 		panic(&appError{e, "Failed to update story", http.StatusInternalServerError})
 	}
 }
 
-func clearKind(c appengine.Context, kind string) {
+// Deletes the story along with its StoryAuthor children.
+func (s datastoreStore) DeleteStory(id string) {
+	e := datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+		key := datastore.NewKey(c, "Story", id, 0, nil)
+		keys, err := datastore.NewQuery("StoryAuthor").Ancestor(key).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		return datastore.DeleteMulti(c, append(keys, key))
+	}, nil)
+	if e != nil {
+		panic(&appError{e, "Failed to delete story", http.StatusInternalServerError})
+	}
+}
+
+func (s datastoreStore) clearKind(kind string) {
 	q := datastore.NewQuery(kind).KeysOnly()
-	keys, err := q.GetAll(c, nil)
+	keys, err := q.GetAll(s.c, nil)
 	if err != nil {
 		panic(&appError{err, "Failed to fetch all " + kind, 500})
 	}
-	if err := datastore.DeleteMulti(c, keys); err != nil {
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
 		panic(&appError{err, "Failed to delete all " + kind, 500})
 	}
 }
 
-func clearDatastore(c appengine.Context) {
-	clearKind(c, "Story")
-	clearKind(c, "StoryAuthor")
-	clearKind(c, "UserInfo")
+func (s datastoreStore) Clear() {
+	s.clearKind("Story")
+	s.clearKind("StoryAuthor")
+	s.clearKind("UserInfo")
+	s.clearKind("LoginToken")
+	s.clearKind("Session")
+	s.clearKind("APIToken")
+	s.clearKind("Webhook")
+	s.clearKind("WebhookDelivery")
+	s.clearKind("OutboxMessage")
+}
+
+// Retrieves a name from the cache (or datastore).  Returns nil if no
+// name is set.
+func (s datastoreStore) GetName(email string) *string {
+	result, err := memcache.Get(s.c, "nameforemail:"+email)
+	var name string
+	if err != nil && err != memcache.ErrCacheMiss {
+		panic(&appError{err, "Unknown memcache error", 500}) // who knows what this could be...
+	}
+	if err == nil {
+		name = string(result.Value)
+		if name != "" {
+			return &name
+		}
+		return nil
+	}
+	// Cache miss: go to datastore
+	info := new(UserInfo)
+	// TODO(sdh): due to a bug, this returns the wrong error, so
+	// we can't distinguish a missing entity from other failures.
+	if err := datastore.Get(s.c, datastore.NewKey(s.c, "UserInfo", email, 0, nil), info); err == nil {
+		name = info.Name
+	}
+	s.cacheName(name, email)
+	if name != "" {
+		return &name
+	}
+	return nil
+}
+
+// Stores a name for the given email, in both the datastore and cache.
+func (s datastoreStore) PutName(name, email string) {
+	info := s.GetUserInfo(email)
+	if info == nil {
+		info = &UserInfo{Email: email}
+	}
+	info.Name = name
+	key := datastore.NewKey(s.c, "UserInfo", email, 0, nil)
+	if _, err := datastore.Put(s.c, key, info); err != nil {
+		return // best effort
+	}
+	s.cacheName(name, email)
+}
+
+// Retrieves the user's info straight from the datastore.
+func (s datastoreStore) GetUserInfo(email string) *UserInfo {
+	info := new(UserInfo)
+	// TODO(sdh): as in GetName, any error is treated as a missing entity.
+	if err := datastore.Get(s.c, datastore.NewKey(s.c, "UserInfo", email, 0, nil), info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// Stores the user's info, and drops the cached name so that the next
+// GetName picks up the change.
+func (s datastoreStore) PutUserInfo(info UserInfo) {
+	key := datastore.NewKey(s.c, "UserInfo", info.Email, 0, nil)
+	if _, err := datastore.Put(s.c, key, &info); err != nil {
+		panic(&appError{err, "Failed to save user info", 500})
+	}
+	if err := memcache.Delete(s.c, "nameforemail:"+info.Email); err != nil && err != memcache.ErrCacheMiss {
+		s.c.Errorf("Failed to invalidate cached name for %s: %v", info.Email, err)
+	}
+}
+
+func (s datastoreStore) DigestUsers() []UserInfo {
+	q := datastore.NewQuery("UserInfo").Filter("Notify =", notifyDigest)
+	var users []UserInfo
+	if _, err := q.GetAll(s.c, &users); err != nil {
+		panic(&appError{err, "Failed to fetch digest users", 500})
+	}
+	return users
+}
+
+func (s datastoreStore) cacheName(name, email string) {
+	memcache.Set(s.c, &memcache.Item{
+		Key:   "nameforemail:" + email,
+		Value: []byte(name),
+	})
+}
+
+func (s datastoreStore) PutLoginToken(token LoginToken) {
+	key := datastore.NewKey(s.c, "LoginToken", token.Id, 0, nil)
+	if _, err := datastore.Put(s.c, key, &token); err != nil {
+		panic(&appError{err, "Failed to save login token", 500})
+	}
+}
+
+func (s datastoreStore) TakeLoginToken(id string) *LoginToken {
+	var token *LoginToken
+	err := datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+		key := datastore.NewKey(c, "LoginToken", id, 0, nil)
+		t := new(LoginToken)
+		if err := datastore.Get(c, key, t); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		token = t
+		return datastore.Delete(c, key)
+	}, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch login token", 500})
+	}
+	return token
+}
+
+// Filters on Email alone, since an address only has a few tokens, and
+// adding Expires would need a composite index.
+func (s datastoreStore) HasLoginToken(email string, expiresAfter time.Time) bool {
+	var tokens []LoginToken
+	if _, err := datastore.NewQuery("LoginToken").Filter("Email =", email).GetAll(s.c, &tokens); err != nil {
+		panic(&appError{err, "Failed to fetch login tokens", 500})
+	}
+	for _, token := range tokens {
+		if token.Expires.After(expiresAfter) {
+			return true
+		}
+	}
+	return false
 }
 
-func deleteStoryAuthors(c appengine.Context, id string) {
+func (s datastoreStore) PurgeLoginTokens(expiredBefore time.Time) {
+	keys, err := datastore.NewQuery("LoginToken").Filter("Expires <", expiredBefore).KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch expired login tokens", 500})
+	}
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
+		panic(&appError{err, "Failed to delete expired login tokens", 500})
+	}
+}
+
+func (s datastoreStore) PutSession(session Session) {
+	key := datastore.NewKey(s.c, "Session", session.Id, 0, nil)
+	if _, err := datastore.Put(s.c, key, &session); err != nil {
+		panic(&appError{err, "Failed to save session", 500})
+	}
+}
+
+func (s datastoreStore) GetSession(id string) *Session {
+	session := new(Session)
+	if err := datastore.Get(s.c, datastore.NewKey(s.c, "Session", id, 0, nil), session); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		panic(&appError{err, "Failed to fetch session", 500})
+	}
+	return session
+}
+
+func (s datastoreStore) UserSessions(email string) []Session {
+	var sessions []Session
+	if _, err := datastore.NewQuery("Session").Filter("Email =", email).GetAll(s.c, &sessions); err != nil {
+		panic(&appError{err, "Failed to fetch sessions", 500})
+	}
+	sort.Sort(byLastSeen(sessions))
+	return sessions
+}
+
+func (s datastoreStore) DeleteSession(id string) {
+	if err := datastore.Delete(s.c, datastore.NewKey(s.c, "Session", id, 0, nil)); err != nil {
+		panic(&appError{err, "Failed to delete session", 500})
+	}
+}
+
+func (s datastoreStore) PurgeSessions(expiredBefore time.Time) {
+	keys, err := datastore.NewQuery("Session").Filter("Expires <", expiredBefore).KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch expired sessions", 500})
+	}
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
+		panic(&appError{err, "Failed to delete expired sessions", 500})
+	}
+}
+
+func (s datastoreStore) PutAPIToken(token APIToken) {
+	key := datastore.NewKey(s.c, "APIToken", token.Hash, 0, nil)
+	if _, err := datastore.Put(s.c, key, &token); err != nil {
+		panic(&appError{err, "Failed to save API token", 500})
+	}
+}
+
+func (s datastoreStore) GetAPIToken(hash string) *APIToken {
+	token := new(APIToken)
+	if err := datastore.Get(s.c, datastore.NewKey(s.c, "APIToken", hash, 0, nil), token); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		panic(&appError{err, "Failed to fetch API token", 500})
+	}
+	return token
+}
+
+func (s datastoreStore) UserAPITokens(email string) []APIToken {
+	var tokens []APIToken
+	if _, err := datastore.NewQuery("APIToken").Filter("Email =", email).GetAll(s.c, &tokens); err != nil {
+		panic(&appError{err, "Failed to fetch API tokens", 500})
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens
+}
+
+func (s datastoreStore) DeleteAPIToken(hash string) {
+	if err := datastore.Delete(s.c, datastore.NewKey(s.c, "APIToken", hash, 0, nil)); err != nil {
+		panic(&appError{err, "Failed to delete API token", 500})
+	}
+}
+
+func (s datastoreStore) PutWebhook(hook Webhook) {
+	key := datastore.NewKey(s.c, "Webhook", hook.Id, 0, nil)
+	if _, err := datastore.Put(s.c, key, &hook); err != nil {
+		panic(&appError{err, "Failed to save webhook", 500})
+	}
+}
+
+func (s datastoreStore) GetWebhook(id string) *Webhook {
+	hook := new(Webhook)
+	if err := datastore.Get(s.c, datastore.NewKey(s.c, "Webhook", id, 0, nil), hook); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		panic(&appError{err, "Failed to fetch webhook", 500})
+	}
+	return hook
+}
+
+func (s datastoreStore) UserWebhooks(email string) []Webhook {
+	var hooks []Webhook
+	if _, err := datastore.NewQuery("Webhook").Filter("Email =", email).GetAll(s.c, &hooks); err != nil {
+		panic(&appError{err, "Failed to fetch webhooks", 500})
+	}
+	sort.Sort(webhooksByCreated(hooks))
+	return hooks
+}
+
+func (s datastoreStore) DeleteWebhook(id string) {
+	keys, err := datastore.NewQuery("WebhookDelivery").Filter("WebhookId =", id).KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch webhook deliveries", 500})
+	}
+	keys = append(keys, datastore.NewKey(s.c, "Webhook", id, 0, nil))
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
+		panic(&appError{err, "Failed to delete webhook", 500})
+	}
+}
+
+// Deliveries are kept in their story's entity group, like outbox
+// messages.  Those from before deliveries had a StoryId have no parent.
+func deliveryKey(c appengine.Context, d WebhookDelivery) *datastore.Key {
+	var parent *datastore.Key
+	if d.StoryId != "" {
+		parent = datastore.NewKey(c, "Story", d.StoryId, 0, nil)
+	}
+	return datastore.NewKey(c, "WebhookDelivery", d.Id, 0, parent)
+}
+
+func (s datastoreStore) PutDelivery(d WebhookDelivery) {
+	if _, err := datastore.Put(s.c, deliveryKey(s.c, d), &d); err != nil {
+		panic(&appError{err, "Failed to save webhook delivery", 500})
+	}
+}
+
+func (s datastoreStore) DueDeliveries(due time.Time, limit int) []WebhookDelivery {
+	var deliveries []WebhookDelivery
+	q := datastore.NewQuery("WebhookDelivery").Filter("State =", deliveryPending).
+		Filter("NextAttempt <=", due).Order("NextAttempt").Limit(limit)
+	if _, err := q.GetAll(s.c, &deliveries); err != nil {
+		panic(&appError{err, "Failed to fetch due webhook deliveries", 500})
+	}
+	return deliveries
+}
+
+func (s datastoreStore) WebhookDeliveries(webhookId string, limit int) []WebhookDelivery {
+	var deliveries []WebhookDelivery
+	q := datastore.NewQuery("WebhookDelivery").Filter("WebhookId =", webhookId).Order("-Created").Limit(limit)
+	if _, err := q.GetAll(s.c, &deliveries); err != nil {
+		panic(&appError{err, "Failed to fetch webhook deliveries", 500})
+	}
+	return deliveries
+}
+
+// The datastore only allows one inequality filter, so each finished
+// state is purged separately.
+func (s datastoreStore) PurgeDeliveries(createdBefore time.Time) {
+	for _, state := range []string{deliveryDelivered, deliveryFailed} {
+		keys, err := datastore.NewQuery("WebhookDelivery").Filter("State =", state).
+			Filter("Created <", createdBefore).KeysOnly().GetAll(s.c, nil)
+		if err != nil {
+			panic(&appError{err, "Failed to fetch old webhook deliveries", 500})
+		}
+		if err := datastore.DeleteMulti(s.c, keys); err != nil {
+			panic(&appError{err, "Failed to delete old webhook deliveries", 500})
+		}
+	}
+}
+
+// Outbox messages about a story are kept in its entity group, so that
+// UpdateStory can queue them in the same transaction.
+func outboxKey(c appengine.Context, m OutboxMessage) *datastore.Key {
+	var parent *datastore.Key
+	if m.StoryId != "" {
+		parent = datastore.NewKey(c, "Story", m.StoryId, 0, nil)
+	}
+	return datastore.NewKey(c, "OutboxMessage", m.Id, 0, parent)
+}
+
+// Saves the messages and deliveries queued by a story update, within its
+// transaction.
+func putQueued(c appengine.Context, queued Queued) error {
+	if len(queued.Outbox) > 0 {
+		keys := make([]*datastore.Key, len(queued.Outbox))
+		for i, m := range queued.Outbox {
+			keys[i] = outboxKey(c, m)
+		}
+		if _, err := datastore.PutMulti(c, keys, queued.Outbox); err != nil {
+			return err
+		}
+	}
+	if len(queued.Deliveries) > 0 {
+		keys := make([]*datastore.Key, len(queued.Deliveries))
+		for i, d := range queued.Deliveries {
+			keys[i] = deliveryKey(c, d)
+		}
+		if _, err := datastore.PutMulti(c, keys, queued.Deliveries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s datastoreStore) PutOutboxMessage(m OutboxMessage) {
+	if _, err := datastore.Put(s.c, outboxKey(s.c, m), &m); err != nil {
+		panic(&appError{err, "Failed to queue message", 500})
+	}
+}
+
+// Since a message's key depends on its story, it's found by querying.
+func (s datastoreStore) GetOutboxMessage(id string) *OutboxMessage {
+	var msgs []OutboxMessage
+	if _, err := datastore.NewQuery("OutboxMessage").Filter("Id =", id).GetAll(s.c, &msgs); err != nil {
+		panic(&appError{err, "Failed to fetch queued message", 500})
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return &msgs[0]
+}
+
+func (s datastoreStore) DeleteOutboxMessage(id string) {
+	keys, err := datastore.NewQuery("OutboxMessage").Filter("Id =", id).KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch queued message", 500})
+	}
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
+		panic(&appError{err, "Failed to delete queued message", 500})
+	}
+}
+
+func (s datastoreStore) DueOutboxMessages(due time.Time, limit int) []OutboxMessage {
+	var msgs []OutboxMessage
+	q := datastore.NewQuery("OutboxMessage").Filter("State =", outboxPending).
+		Filter("NextAttempt <=", due).Order("NextAttempt").Limit(limit)
+	if _, err := q.GetAll(s.c, &msgs); err != nil {
+		panic(&appError{err, "Failed to fetch due messages", 500})
+	}
+	return msgs
+}
+
+func (s datastoreStore) DeadOutboxMessages(limit int) []OutboxMessage {
+	var msgs []OutboxMessage
+	q := datastore.NewQuery("OutboxMessage").Filter("State =", outboxDead).Order("-LastAttempt").Limit(limit)
+	if _, err := q.GetAll(s.c, &msgs); err != nil {
+		panic(&appError{err, "Failed to fetch dead messages", 500})
+	}
+	return msgs
+}
+
+func (s datastoreStore) PurgeOutbox(createdBefore time.Time) {
+	keys, err := datastore.NewQuery("OutboxMessage").Filter("State =", outboxSent).
+		Filter("Created <", createdBefore).KeysOnly().GetAll(s.c, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch sent messages", 500})
+	}
+	if err := datastore.DeleteMulti(s.c, keys); err != nil {
+		panic(&appError{err, "Failed to delete sent messages", 500})
+	}
+}
+
+// Singleton entity holding the signing key.
+type signingKey struct {
+	Key []byte
+}
+
+// Returns the signing key, from memcache if possible.  The first
+// caller creates it, in a transaction so that there's only ever one.
+func (s datastoreStore) SigningKey() []byte {
+	if item, err := memcache.Get(s.c, "signingkey"); err == nil {
+		return item.Value
+	}
+	k := new(signingKey)
+	err := datastore.RunInTransaction(s.c, func(c appengine.Context) error {
+		key := datastore.NewKey(c, "SigningKey", "default", 0, nil)
+		err := datastore.Get(c, key, k)
+		if err == datastore.ErrNoSuchEntity {
+			k.Key = []byte(randomString(32))
+			_, err = datastore.Put(c, key, k)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		panic(&appError{err, "Failed to fetch signing key", 500})
+	}
+	memcache.Set(s.c, &memcache.Item{Key: "signingkey", Value: k.Key})
+	return k.Key
+}
+
+func (s datastoreStore) FlushUserCache() {
+	if err := memcache.Flush(s.c); err != nil {
+		panic(&appError{err, "Error flushing memcache", 500})
+	}
 }
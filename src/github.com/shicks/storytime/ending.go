@@ -0,0 +1,220 @@
+package storytime
+
+// How stories end.  Each story picks a completion rule when it's begun,
+// and the rule's policy decides whether each new part finishes the story
+// and explains to the next author how it will end.
+//
+// When a policy can tell that the next part will be the last (e.g. when
+// few words are left), that turn is the closing turn: the author is told
+// theirs is the final part, and it ends the story however long it is.
+// Under endAtWords they may run a little past the word count to finish
+// their sentence, but no more.  Under endAtDeadline, the timeouts task
+// ends the story soon after the deadline whether or not the closing
+// turn is written, so its author isn't promised the last part.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Completion rules.
+const (
+	// When the story reaches Words words.
+	endAtWords = ""
+	// When each author has had EndCount turns.
+	endAfterRounds = "rounds"
+	// When EndCount parts have been written.
+	endAfterParts = "parts"
+	// With the first part written once Deadline has passed, or by the
+	// timeouts task soon after it if no one writes one first.  (A story
+	// with no parts by then is archived instead.)
+	endAtDeadline = "deadline"
+	// When the creator ends it, from the story's page.
+	endByCreator = "creator"
+	// When an author ends their part with "The End".
+	endWithTheEnd = "theend"
+)
+
+// Decides when a story is complete.
+type completionPolicy interface {
+	// Returns whether the story is complete, now that its last part has
+	// been added.  The text is the part as the author wrote it.
+	complete(s Story, text string) bool
+	// Explains to the next author how (and when) the story will end.
+	describe(s Story) string
+	// Returns whether the next part will be the last.
+	closing(s Story) bool
+}
+
+const (
+	// Under endAtWords, the turn is the closing turn once this few words
+	// are left, unless the story's word quota is larger.
+	closingTurnWords = 40
+	// Most words the closing turn may run past the word count.
+	closingOverrun = 30
+)
+
+var completionPolicies = map[string]completionPolicy{
+	endAtWords:     wordsPolicy{},
+	endAfterRounds: roundsPolicy{},
+	endAfterParts:  partsPolicy{},
+	endAtDeadline:  deadlinePolicy{},
+	endByCreator:   creatorPolicy{},
+	endWithTheEnd:  theEndPolicy{},
+}
+
+// Returns the story's completion policy.
+func (s Story) completion() completionPolicy {
+	if policy, ok := completionPolicies[s.EndRule]; ok {
+		return policy
+	}
+	panic(fmt.Errorf("Unknown completion rule %q for story %s", s.EndRule, s.Id))
+}
+
+// Explains how the story will end.
+func (s Story) EndDescription() string {
+	return s.completion().describe(s)
+}
+
+// Returns whether the story ends when it reaches its word count, so that
+// the words remaining are worth showing.
+func (s Story) EndsAtWords() bool {
+	return s.EndRule == endAtWords
+}
+
+// Returns whether the next part will end the story.
+func (s Story) ClosingTurn() bool {
+	return s.Active() && s.completion().closing(s)
+}
+
+// Returns whether the story waits for the closing turn, so that its
+// author can be told ahead of time (e.g. by mail) that theirs is the last
+// part.  Deadline stories may end without it.
+func (s Story) closingGuaranteed() bool {
+	return s.ClosingTurn() && s.EndRule != endAtDeadline
+}
+
+// Returns the most words the closing turn may have, or 0 if there's no
+// limit beyond the story's length limits.
+func (s Story) ClosingMaxWords() int {
+	if !s.EndsAtWords() || !s.ClosingTurn() {
+		return 0
+	}
+	return s.WordsLeft() + closingOverrun
+}
+
+// Tells the author of the closing turn that theirs is the last part.
+func (s Story) ClosingDescription() string {
+	if s.EndRule == endAtDeadline {
+		return "The story's deadline has passed, so if you write your part before it ends, yours will be the last."
+	}
+	if max := s.ClosingMaxWords(); max > 0 {
+		return fmt.Sprintf("Yours is the last part of the story, so please bring it to a close in about %d words "+
+			"(or at most %d, to finish your sentence).", s.WordsLeft(), max)
+	}
+	return "Yours is the last part of the story, so please bring it to a close."
+}
+
+type wordsPolicy struct{}
+
+func (wordsPolicy) complete(s Story, text string) bool {
+	return s.WordCount() >= s.Words
+}
+
+func (wordsPolicy) describe(s Story) string {
+	return fmt.Sprintf("The story will end once it reaches %d words; %d words remain.", s.Words, s.WordsLeft())
+}
+
+func (wordsPolicy) closing(s Story) bool {
+	threshold := closingTurnWords
+	if s.WordQuota > threshold {
+		threshold = s.WordQuota
+	}
+	return s.WordsLeft() <= threshold
+}
+
+type roundsPolicy struct{}
+
+// Returns how many parts the story will have, with its current authors.
+func (roundsPolicy) parts(s Story) int {
+	return s.EndCount * len(s.Authors)
+}
+
+func (p roundsPolicy) complete(s Story, text string) bool {
+	return len(s.Parts) >= p.parts(s)
+}
+
+func (p roundsPolicy) describe(s Story) string {
+	return fmt.Sprintf("The story will end after %s, with %s in all; %s written so far.",
+		fmtPlural(s.EndCount, "one round"), fmtPlural(p.parts(s), "one part"), fmtPlural(len(s.Parts), "one part"))
+}
+
+func (p roundsPolicy) closing(s Story) bool {
+	return len(s.Parts)+1 >= p.parts(s)
+}
+
+type partsPolicy struct{}
+
+func (partsPolicy) complete(s Story, text string) bool {
+	return len(s.Parts) >= s.EndCount
+}
+
+func (partsPolicy) describe(s Story) string {
+	return fmt.Sprintf("The story will end after %s; %s written so far.",
+		fmtPlural(s.EndCount, "one part"), fmtPlural(len(s.Parts), "one part"))
+}
+
+func (partsPolicy) closing(s Story) bool {
+	return len(s.Parts)+1 >= s.EndCount
+}
+
+type deadlinePolicy struct{}
+
+func (deadlinePolicy) complete(s Story, text string) bool {
+	return !s.LastPart().Written.Before(s.Deadline)
+}
+
+func (deadlinePolicy) describe(s Story) string {
+	if !time.Now().Before(s.Deadline) {
+		return "The story's deadline has passed, so it will end shortly, with the next part if that's written first."
+	}
+	return fmt.Sprintf("The story will end %s, on %s.", fuzzyUntil(s.Deadline), s.Deadline.Format("January 2, 2006"))
+}
+
+func (deadlinePolicy) closing(s Story) bool {
+	return !time.Now().Before(s.Deadline)
+}
+
+type creatorPolicy struct{}
+
+func (creatorPolicy) complete(s Story, text string) bool {
+	return false
+}
+
+func (creatorPolicy) describe(s Story) string {
+	return "The story will end when its creator decides it's finished."
+}
+
+func (creatorPolicy) closing(s Story) bool {
+	return false
+}
+
+type theEndPolicy struct{}
+
+// Matches "The End" at the very end of the part, either on a line of its
+// own or as a sentence of its own (the m flag only applies to ^).
+var theEnd = regexp.MustCompile(`(?im)(^|[.!?]["'\x{201D}\x{2019}]*\s+)the end[.!]*\s*\z`)
+
+func (theEndPolicy) complete(s Story, text string) bool {
+	return theEnd.MatchString(strings.TrimSpace(text))
+}
+
+func (theEndPolicy) describe(s Story) string {
+	return "The story will end when an author finishes their part with \"The End\"."
+}
+
+func (theEndPolicy) closing(s Story) bool {
+	return false
+}
@@ -0,0 +1,80 @@
+package storytime
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns n parts of the given number of words each, by the authors in
+// turn.
+func testParts(n, words int, authors ...string) []StoryPart {
+	parts := make([]StoryPart, n)
+	for i := range parts {
+		parts[i] = StoryPart{
+			Visible: strings.TrimSpace(strings.Repeat("word ", words)),
+			Written: time.Now(),
+			Author:  authors[i%len(authors)],
+		}
+	}
+	return parts
+}
+
+func TestCompletionPolicies(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		// The story before the part is written, and the part.
+		story    Story
+		text     string
+		closing  bool
+		complete bool
+	}{
+		{"words: plenty left", Story{Words: 100, Parts: testParts(1, 10, "a")}, "one two", false, false},
+		{"words: closing", Story{Words: 100, Parts: testParts(1, 60, "a")}, "one two", true, false},
+		{"words: quota makes closing sooner", Story{Words: 100, WordQuota: 50, Parts: testParts(1, 55, "a")},
+			"one two", true, false},
+		{"words: reached", Story{Words: 100, Parts: testParts(1, 98, "a")}, "one two", true, true},
+		{"rounds: first round", Story{EndRule: endAfterRounds, EndCount: 2, Authors: []string{"a", "b"}}, "x", false, false},
+		{"rounds: last part", Story{EndRule: endAfterRounds, EndCount: 2, Authors: []string{"a", "b"},
+			Parts: testParts(3, 1, "a", "b")}, "x", true, true},
+		{"parts: not yet", Story{EndRule: endAfterParts, EndCount: 3, Parts: testParts(1, 1, "a")}, "x", false, false},
+		{"parts: last part", Story{EndRule: endAfterParts, EndCount: 3, Parts: testParts(2, 1, "a")}, "x", true, true},
+		{"deadline: before", Story{EndRule: endAtDeadline, Deadline: future}, "x", false, false},
+		{"deadline: after", Story{EndRule: endAtDeadline, Deadline: past}, "x", true, true},
+		{"creator", Story{EndRule: endByCreator, Parts: testParts(10, 100, "a")}, "The End.", false, false},
+		{"the end", Story{EndRule: endWithTheEnd}, "And they slept.  The End.", false, true},
+		{"the end on its own line", Story{EndRule: endWithTheEnd}, "And they slept.\nTHE END", false, true},
+		{"the end mid-sentence", Story{EndRule: endWithTheEnd}, "It was the end of the day.", false, false},
+		{"the end not last", Story{EndRule: endWithTheEnd}, "The End.  Or was it?", false, false},
+	}
+	for _, test := range tests {
+		s := test.story
+		if closing := s.ClosingTurn(); closing != test.closing {
+			t.Errorf("%s: ClosingTurn() = %v, want %v", test.name, closing, test.closing)
+		}
+		s.Parts = append(s.Parts, StoryPart{Visible: test.text, Written: time.Now()})
+		if complete := s.completion().complete(s, test.text); complete != test.complete {
+			t.Errorf("%s: complete = %v, want %v", test.name, complete, test.complete)
+		}
+	}
+}
+
+func TestClosingGuaranteed(t *testing.T) {
+	tests := []struct {
+		name  string
+		story Story
+		want  bool
+	}{
+		{"words", Story{Words: 10}, true},
+		{"parts", Story{EndRule: endAfterParts, EndCount: 1}, true},
+		{"not closing", Story{EndRule: endAfterParts, EndCount: 5}, false},
+		{"deadline", Story{EndRule: endAtDeadline, Deadline: time.Now().Add(-time.Hour)}, false},
+		{"complete", Story{Words: 10, Complete: true}, false},
+	}
+	for _, test := range tests {
+		if got := test.story.closingGuaranteed(); got != test.want {
+			t.Errorf("%s: closingGuaranteed() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package storytime
+
+// Atom feeds of completed stories, at /completed.atom for everyone's
+// stories and /completed.atom?author=EMAIL for one author's.
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Number of stories in a feed.
+const feedLength = 20
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Id        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Published string       `xml:"published"`
+	Updated   string       `xml:"updated"`
+	Link      atomLink     `xml:"link"`
+	Authors   []atomAuthor `xml:"author"`
+	Content   atomContent  `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// Atom timestamps are RFC 3339.
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Response that writes an Atom feed.
+type atomResponse struct {
+	feed *atomFeed
+}
+
+func (r atomResponse) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(r.feed); err != nil {
+		panic(&appError{err, "Failed to write feed", http.StatusInternalServerError})
+	}
+}
+
+// Handles /completed.atom.
+func completedFeed(r request) response {
+	if r.matchPath("/completed.atom") == nil {
+		return notFound
+	}
+	self := config.BaseURL + "/completed.atom"
+	title := "Storytime: completed stories"
+	var stories []Story
+	if author := r.req.FormValue("author"); author != "" {
+		self += "?author=" + url.QueryEscape(author)
+		title = "Storytime: stories by " + nameFunc(r.store())(author)
+		stories = r.store().CompletedStoriesBy(author, feedLength)
+	} else {
+		stories = r.store().CompletedStories(feedLength, time.Now())
+	}
+
+	feed := &atomFeed{
+		Id:    self,
+		Title: title,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "text/html", Href: config.BaseURL + "/completed"},
+		},
+		Entries: make([]atomEntry, len(stories)),
+	}
+	// The feed was last updated when its newest story was finished.
+	updated := time.Unix(0, 0)
+	names := nameFunc(r.store())
+	for i, story := range stories {
+		if story.Modified.After(updated) {
+			updated = story.Modified
+		}
+		link := config.BaseURL + "/story/" + story.Id
+		entry := atomEntry{
+			Id:        link,
+			Title:     story.Snippet(),
+			Published: atomTime(story.Created),
+			Updated:   atomTime(story.Modified),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+			Content:   atomContent{"text", strings.TrimSpace(story.FullText())},
+		}
+		for _, author := range story.Authors {
+			entry.Authors = append(entry.Authors, atomAuthor{names(author)})
+		}
+		feed.Entries[i] = entry
+	}
+	feed.Updated = atomTime(updated)
+	return atomResponse{feed}
+}
@@ -0,0 +1,150 @@
+package storytime
+
+// Parsing of inbound email replies.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Returns the address that replies to the notification for the story's
+// next part should be sent to, or "" if replies aren't configured.
+func replyAddress(story Story) string {
+	if config.ReplyDomain == "" {
+		return ""
+	}
+	return fmt.Sprintf("story-%s-%s@%s", story.Id, story.NextId, config.ReplyDomain)
+}
+
+// Extracts the story and part IDs from a reply address.
+func parseReplyAddress(address string) (storyId, partId string, ok bool) {
+	local := strings.SplitN(address, "@", 2)[0]
+	if !strings.HasPrefix(local, "story-") {
+		return "", "", false
+	}
+	ids := strings.Split(strings.TrimPrefix(local, "story-"), "-")
+	if len(ids) != 2 || ids[0] == "" || ids[1] == "" {
+		return "", "", false
+	}
+	return ids[0], ids[1], true
+}
+
+// Reads an email, returning the sender's address and the text of
+// their reply, with any quoted text and signature removed.
+func parseReply(r io.Reader) (string, string, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return "", "", err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return "", "", err
+	}
+	body, err := plainTextBody(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return from.Address, stripQuoted(body), nil
+}
+
+// Returns the text/plain content of a (possibly multipart) body.
+func plainTextBody(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// A missing content type means plain text.
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			// Note: multipart already decodes quoted-printable parts.
+			text, err := plainTextBody(part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"), part)
+			if err == nil {
+				return text, nil
+			}
+		}
+		return "", errors.New("No text/plain part in " + mediaType)
+	}
+	if mediaType != "text/plain" {
+		return "", errors.New("Not plain text: " + mediaType)
+	}
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	text, err := ioutil.ReadAll(body)
+	return string(text), err
+}
+
+var (
+	// Lines starting with these mark the end of the reply.
+	replyTerminators = []string{
+		">",
+		"-----Original Message-----",
+		"________________________________",
+		"Sent from my ",
+	}
+	// Attribution lines like "On Mon, Jan 2, 2006, Steve <...> wrote:".
+	attributionLine = regexp.MustCompile(`^On\s.*\swrote:$`)
+)
+
+// Strips quoted text and signatures from an email reply.  Since email
+// clients hard-wrap lines, the lines of each paragraph are joined back
+// together, so that the whole of the last paragraph (rather than just
+// its last line) counts as the part's last line.
+func stripQuoted(text string) string {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	var paragraphs []string
+	var paragraph []string
+	endParagraph := func() {
+		if len(paragraph) > 0 {
+			paragraphs = append(paragraphs, strings.Join(paragraph, " "))
+			paragraph = nil
+		}
+	}
+lines:
+	for i, line := range lines {
+		if line == "-- " || line == "--" {
+			break // signature
+		}
+		for _, terminator := range replyTerminators {
+			if strings.HasPrefix(line, terminator) {
+				break lines
+			}
+		}
+		trimmed := strings.TrimSpace(line)
+		if attributionLine.MatchString(trimmed) {
+			break
+		}
+		// Attribution lines are often wrapped onto a second line.
+		if i+1 < len(lines) && strings.HasPrefix(trimmed, "On ") &&
+			attributionLine.MatchString(trimmed+" "+strings.TrimSpace(lines[i+1])) {
+			break
+		}
+		if trimmed == "" {
+			endParagraph()
+		} else {
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	endParagraph()
+	return strings.Join(paragraphs, "\n")
+}
@@ -0,0 +1,97 @@
+package storytime
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripQuoted(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "The cat sat.", "The cat sat."},
+		{"crlf", "The cat\r\nsat.\r\n", "The cat sat."},
+		{"paragraphs", "The cat\nsat.\n\nThen it\nslept.", "The cat sat.\nThen it slept."},
+		{"quoted", "The cat sat.\n\n> Please write\n> the next part.", "The cat sat."},
+		{"attribution", "The cat sat.\n\nOn Mon, Jan 2, 2006, Storytime <s@x.com> wrote:\n> Please", "The cat sat."},
+		{"wrapped attribution", "The cat sat.\n\nOn Mon, Jan 2, 2006, Storytime\n<s@x.com> wrote:\n> Please", "The cat sat."},
+		{"signature", "The cat sat.\n-- \nSteve", "The cat sat."},
+		{"outlook", "The cat sat.\n-----Original Message-----\nFrom: Storytime", "The cat sat."},
+		{"mobile", "The cat sat.\n\nSent from my phone", "The cat sat."},
+		{"starts with On", "On the mat, the cat sat.", "On the mat, the cat sat."},
+		{"empty", "> only quoted", ""},
+	}
+	for _, test := range tests {
+		if got := stripQuoted(test.text); got != test.want {
+			t.Errorf("%s: stripQuoted(%q) = %q, want %q", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		name, msg  string
+		from, text string
+		wantErr    bool
+	}{
+		{
+			name: "plain",
+			msg:  "From: Al <al@x.com>\r\nSubject: Re: story\r\n\r\nThe cat sat.\r\n\r\n> Please write\r\n",
+			from: "al@x.com", text: "The cat sat.",
+		},
+		{
+			name: "quoted-printable",
+			msg: "From: al@x.com\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+				"The caf=C3=A9 was=\r\n open.\r\n",
+			from: "al@x.com", text: "The café was open.",
+		},
+		{
+			name: "multipart",
+			msg: "From: al@x.com\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>The cat sat.</p>\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nThe cat sat.\r\n--b--\r\n",
+			from: "al@x.com", text: "The cat sat.",
+		},
+		{
+			name:    "no sender",
+			msg:     "Subject: Re: story\r\n\r\nThe cat sat.\r\n",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		from, text, err := parseReply(strings.NewReader(test.msg))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: parseReply succeeded, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseReply failed: %v", test.name, err)
+		} else if from != test.from || text != test.text {
+			t.Errorf("%s: parseReply = %q, %q, want %q, %q", test.name, from, text, test.from, test.text)
+		}
+	}
+}
+
+func TestParseReplyAddress(t *testing.T) {
+	tests := []struct {
+		address         string
+		storyId, partId string
+		ok              bool
+	}{
+		{"story-abc-def123@reply.test", "abc", "def123", true},
+		{"story-abc-def123", "abc", "def123", true},
+		{"story-abc@reply.test", "", "", false},
+		{"story--def@reply.test", "", "", false},
+		{"story-a-b-c@reply.test", "", "", false},
+		{"someone@reply.test", "", "", false},
+	}
+	for _, test := range tests {
+		storyId, partId, ok := parseReplyAddress(test.address)
+		if storyId != test.storyId || partId != test.partId || ok != test.ok {
+			t.Errorf("parseReplyAddress(%q) = %q, %q, %v, want %q, %q, %v",
+				test.address, storyId, partId, ok, test.storyId, test.partId, test.ok)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package storytime
+
+// Passwordless login: users enter their email address and are sent a
+// single-use link, which starts a session (see sessions.go).
+// This works alongside the platform's own accounts, so that nobody
+// needs a Google account to play.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// How long an emailed login link stays valid.
+	loginTokenLifetime = time.Hour
+	// How long after sending a login link to an address before another
+	// can be sent to it.
+	loginLinkCooldown = time.Minute
+)
+
+// An emailed login link that hasn't been used yet.
+type LoginToken struct {
+	// Random ID, which is also the key.
+	Id string
+	// The address the link was sent to.
+	Email string
+	// When the link stops working.
+	Expires time.Time
+}
+
+// Returns a hex HMAC of the given fields under the store's signing key.
+// The purpose keeps a signature for one thing from being used for another.
+func sign(s StoryStore, purpose string, fields ...string) string {
+	mac := hmac.New(sha256.New, s.SigningKey())
+	mac.Write([]byte(purpose))
+	for _, field := range fields {
+		mac.Write([]byte{0})
+		mac.Write([]byte(field))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns whether sig is the signature of the given fields.
+func validSignature(s StoryStore, sig, purpose string, fields ...string) bool {
+	return hmac.Equal([]byte(sig), []byte(sign(s, purpose, fields...)))
+}
+
+// Returns the continue parameter if it's a local path, or else "/".
+func continueParam(r request) string {
+	cont := r.req.FormValue("continue")
+	if !strings.HasPrefix(cont, "/") || strings.HasPrefix(cont, "//") {
+		return "/"
+	}
+	return cont
+}
+
+// Handles /signin: shows the form, and emails a login link to the
+// address that's posted to it.
+func signin(r request) response {
+	if r.matchPath("/signin") == nil {
+		return notFound
+	}
+	page := &signinPage{
+		Continue:      continueParam(r),
+		PlatformLogin: host.loginURL(r.req, continueParam(r)),
+	}
+	if r.req.Method != "POST" {
+		return execute(page)
+	}
+	addr, err := mail.ParseAddress(r.req.FormValue("email"))
+	if err != nil {
+		panic(&appError{err, "Could not parse email address", http.StatusBadRequest})
+	}
+	page.Sent = addr.Address
+	// Asking again straight away sends nothing, so that the form can't be
+	// used to flood someone's inbox.  The page is the same either way.
+	now := time.Now()
+	if r.store().HasLoginToken(addr.Address, now.Add(loginTokenLifetime-loginLinkCooldown)) {
+		return execute(page)
+	}
+	token := LoginToken{
+		Id:      randomString(32),
+		Email:   addr.Address,
+		Expires: now.Add(loginTokenLifetime),
+	}
+	r.store().PutLoginToken(token)
+	link := fmt.Sprintf("%s/signin/verify?token=%s.%s&continue=%s", config.BaseURL,
+		token.Id, sign(r.store(), "login", token.Id, token.Email), url.QueryEscape(page.Continue))
+	sendNotice(r, token.Email, "Sign in to Storytime", fmt.Sprintf("Visit %s to sign in.\n\n"+
+		"The link works once, for the next %s.  If you didn't ask to sign in, you can ignore this email.",
+		link, fuzzyDuration(loginTokenLifetime)))
+	return execute(page)
+}
+
+// Handles /signin/verify, where login links point.  Following the link
+// only shows a button, since mail scanners fetch links and would
+// otherwise use up the token; posting the button logs the user in.
+func verifySignin(r request) response {
+	if r.matchPath("/signin/verify") == nil {
+		return notFound
+	}
+	if r.req.Method != "POST" {
+		return execute(&signinPage{Continue: continueParam(r), Token: r.req.FormValue("token")})
+	}
+	parts := strings.SplitN(r.req.FormValue("token"), ".", 2)
+	if len(parts) != 2 {
+		return errorResponse{400, "Bad Request: malformed login link"}
+	}
+	token := r.store().TakeLoginToken(parts[0])
+	if token == nil || !validSignature(r.store(), parts[1], "login", token.Id, token.Email) {
+		return errorResponse{403, "Forbidden: this login link is invalid or has already been used"}
+	} else if time.Now().After(token.Expires) {
+		return errorResponse{403, "Forbidden: this login link has expired"}
+	}
+	return cookieRedirect{newSession(r, token.Email), redirect(continueParam(r))}
+}
+
+// Handles /signout, which ends the session and then logs out of the
+// platform's accounts too.
+func signout(r request) response {
+	if id := sessionId(r); id != "" {
+		r.store().DeleteSession(id)
+	}
+	return cookieRedirect{
+		&http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1},
+		redirect(host.logoutURL(r.req)),
+	}
+}
@@ -0,0 +1,63 @@
+package storytime
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	st, _ := setUpTest(nil)
+	sig := sign(st, "login", "a@x.com", "token")
+	tests := []struct {
+		name    string
+		sig     string
+		purpose string
+		fields  []string
+		want    bool
+	}{
+		{"same fields", sig, "login", []string{"a@x.com", "token"}, true},
+		{"other purpose", sig, "session", []string{"a@x.com", "token"}, false},
+		{"other field", sig, "login", []string{"b@x.com", "token"}, false},
+		{"moved boundary", sig, "login", []string{"a@x.comt", "oken"}, false},
+		{"fewer fields", sig, "login", []string{"a@x.com"}, false},
+		{"empty signature", "", "login", []string{"a@x.com", "token"}, false},
+	}
+	for _, test := range tests {
+		if got := validSignature(st, test.sig, test.purpose, test.fields...); got != test.want {
+			t.Errorf("%s: validSignature = %v, want %v", test.name, got, test.want)
+		}
+	}
+	if other := sign(newMemoryStore(), "login", "a@x.com", "token"); other == sig {
+		t.Errorf("stores with different keys give the same signature")
+	}
+}
+
+func TestSigninCooldown(t *testing.T) {
+	st, _ := setUpTest(nil)
+	form := url.Values{"email": {"Al <a@x.com>"}}
+	for i := 0; i < 3; i++ {
+		resp, ok := signin(newTestRequest("POST", "/signin", form)).(templateResponse)
+		if !ok || resp.data.(*signinPage).Sent != "a@x.com" {
+			t.Errorf("signin %d: response = %+v", i, resp)
+		}
+	}
+	signin(newTestRequest("POST", "/signin", url.Values{"email": {"b@x.com"}}))
+	sent := make(map[string]int)
+	for _, m := range st.DueOutboxMessages(time.Now(), 10) {
+		sent[m.To[0]]++
+	}
+	if sent["a@x.com"] != 1 || sent["b@x.com"] != 1 {
+		t.Errorf("sent %v login links, want one to each address", sent)
+	}
+
+	// Once the cooldown's over, another link can be sent.
+	for id, token := range st.tokens {
+		token.Expires = token.Expires.Add(-loginLinkCooldown)
+		st.tokens[id] = token
+	}
+	signin(newTestRequest("POST", "/signin", form))
+	if n := len(st.DueOutboxMessages(time.Now(), 10)); n != 3 {
+		t.Errorf("%d login links sent after the cooldown, want 3", n)
+	}
+}
@@ -3,56 +3,183 @@ package storytime
 import (
 	"fmt"
 	"strings"
-
-	"appengine"
-	"appengine/mail"
+	"time"
 )
 
-const (
-	serverUrl string = "http://storytime.brieandsteve.com/story/%s/%s"
-	sender           = "Storytime <storytime@brieandsteve-storytime.appspotmail.com>"
-)
+// Returns the URL for writing the next part of the story.
+func continueUrl(story Story) string {
+	return fmt.Sprintf("%s/story/%s/%s", config.BaseURL, story.Id, story.NextId)
+}
+
+// Queues a link to continue for the next author, by email or chat,
+// unless they've asked for a digest (or nothing) instead.
+func sendMail(r request, story Story) {
+	queueMessages(r, turnMail(r, story)...)
+}
 
-// Sends an email to the author of part with a link to continue.
-func sendMail(c appengine.Context, story Story) {
-	if story.Complete {
-		return
+// Returns the message giving the next author a link to continue, if they
+// want one.
+func turnMail(r request, story Story) []OutboxMessage {
+	if story.Complete || !wantsTurnMessages(notifyPreference(r.store(), story.NextAuthor)) {
+		return nil
 	}
+	return []OutboxMessage{outboxMessage(r, story.Id, turnMessage(r, story))}
+}
+
+// Returns the message reminding the next author that it's their turn.
+// Digest users are already reminded daily, so only immediate and chat
+// users get these.
+func reminderMail(r request, story Story) []OutboxMessage {
+	if !wantsTurnMessages(notifyPreference(r.store(), story.NextAuthor)) {
+		return nil
+	}
+	msg := turnMessage(r, story)
+	msg.Subject = "Reminder: " + msg.Subject
+	msg.Chat = "Reminder: " + msg.Chat
+	if due := story.TimeoutDue(); !due.IsZero() {
+		warning := fmt.Sprintf("\n\nIf you don't write your part %s, your turn will be skipped.", fuzzyUntil(due))
+		msg.Body += warning
+		msg.Chat += warning
+	}
+	return []OutboxMessage{outboxMessage(r, story.Id, msg)}
+}
+
+// Returns the message resending the next author their link, on behalf of
+// a co-author.  Since a nudge is an explicit request, it's sent
+// regardless of preferences.
+func nudgeMail(r request, story Story, by string) []OutboxMessage {
+	msg := turnMessage(r, story)
+	msg.Subject = "Nudge: " + msg.Subject
+	msg.Body = fmt.Sprintf("%s nudged you to write your part.\n\n%s", getFullEmail(r.store(), by), msg.Body)
+	msg.Chat = fmt.Sprintf("%s nudged you to write your part.\n\n%s", getFullEmail(r.store(), by), msg.Chat)
+	return []OutboxMessage{outboxMessage(r, story.Id, msg)}
+}
+
+// Builds the message telling the next author it's their turn.
+func turnMessage(r request, story Story) *Message {
 	var subject, text string
 	part := story.LastPart()
-	url := fmt.Sprintf(serverUrl, story.Id, story.NextId)
-	if part != nil {
+	url := continueUrl(story)
+	if story.closingGuaranteed() {
+		subject = "Please write the last part of this story."
+	} else if part != nil {
 		subject = "Please write the next part of this story."
-		text = fmt.Sprintf("%s, %s wrote:\n> %s\n\nPlease visit %s to write the next part.",
-			capital(fuzzyTime(part.Written)), getFullEmail(c, part.Author), part.Visible, url)
 	} else {
 		subject = "Please write the first part of this story."
+	}
+	if part != nil {
+		text = fmt.Sprintf("%s, %s wrote:\n> %s\n\nPlease visit %s to write the next part.",
+			capital(fuzzyTime(part.Written)), getFullEmail(r.store(), part.Author), part.Visible, url)
+	} else {
 		text = fmt.Sprintf("%s, %s initiated a new story.\n\nPlease visit %s to write the beginning.",
-			capital(fuzzyTime(story.Created)), getFullEmail(c, story.Creator), url)
+			capital(fuzzyTime(story.Created)), getFullEmail(r.store(), story.Creator), url)
+	}
+	if story.closingGuaranteed() {
+		text += "\n\n" + story.ClosingDescription()
 	}
 
-	msg := &mail.Message{
-		Sender:  sender,
+	msg := &Message{
 		To:      []string{story.NextAuthor},
+		ReplyTo: replyAddress(story),
 		Subject: subject,
 		Body:    text,
+		Chat:    text,
 	}
-	if err := mail.Send(c, msg); err != nil {
-		c.Errorf("Couldn't send email: %v", err)
-		panic(err)
+	if msg.ReplyTo != "" {
+		msg.Body += "\n\nYou can also simply reply to this email with your part.  " +
+			"The end of your last paragraph will be visible to the next author."
 	}
+	return msg
+}
+
+// Returns a one-off informational email about the given story (or "").
+func noticeMail(r request, storyId, to, subject, body string) OutboxMessage {
+	return outboxMessage(r, storyId, &Message{
+		To:      []string{to},
+		Subject: subject,
+		Body:    body,
+	})
+}
+
+// Queues a one-off informational email.
+func sendNotice(r request, to, subject, body string) {
+	queueMessages(r, noticeMail(r, "", to, subject, body))
+}
+
+// Lets the sender of an emailed part know it was rejected.
+func sendRejection(r request, to, reason string) {
+	sendNotice(r, to, "Your story part could not be saved.", reason)
 }
 
-// Sends an email only if this story is the author's current story.
-func maybeSendMail(c appengine.Context, story Story) {
-	if story.Complete {
-		return
+// Returns the email (or chat message) telling the next author it's their
+// turn, but only if this story is their current story (and they want to
+// hear about each turn).  CurrentStory is the author's least recently
+// modified story, while a story just passed to them is their most
+// recently modified, so it's only current if nothing else is waiting on
+// them.  That gives the same answer before the story's update is saved
+// as after.
+func maybeTurnMail(r request, story Story) []OutboxMessage {
+	if story.Complete || !wantsTurnMessages(notifyPreference(r.store(), story.NextAuthor)) {
+		return nil
 	}
-	author := story.NextAuthor
-	current := currentStory(c, author)
+	current := r.store().CurrentStory(story.NextAuthor)
 	if current == nil || current.Id == story.Id {
-		sendMail(c, story)
+		return turnMail(r, story)
 	}
+	return nil
+}
+
+// Minimum time between digests.  A bit under a day, so that a daily
+// task running a little early doesn't skip a day.
+const digestInterval = 20 * time.Hour
+
+// Task that sends each digest user a list of the stories waiting on them.
+func sendDigests(r request) response {
+	now := time.Now()
+	for _, info := range r.store().DigestUsers() {
+		if now.Sub(info.LastDigest) < digestInterval {
+			continue
+		}
+		if queueDigest(r, info.Email) {
+			info.LastDigest = now
+			r.store().PutUserInfo(info)
+		}
+	}
+	return errorResponse{200, "OK"}
+}
+
+// Queues one user's digest, returning whether there was anything to send.
+func queueDigest(r request, email string) bool {
+	var waiting []Story
+	for _, story := range r.store().InProgressStories(email) {
+		if story.NextAuthor == email {
+			waiting = append(waiting, story)
+		}
+	}
+	if len(waiting) == 0 {
+		return false
+	}
+	var body []string
+	for _, story := range waiting {
+		var line string
+		if part := story.LastPart(); part != nil {
+			line = fmt.Sprintf("%s wrote:\n> %s", getFullEmail(r.store(), part.Author), part.Visible)
+		} else {
+			line = fmt.Sprintf("%s initiated a new story.", getFullEmail(r.store(), story.Creator))
+		}
+		body = append(body, fmt.Sprintf("%s\nWrite the next part at %s", line, continueUrl(story)))
+	}
+	subject := "A story is waiting for you."
+	if len(waiting) > 1 {
+		subject = fmt.Sprintf("%d stories are waiting for you.", len(waiting))
+	}
+	queueMessages(r, outboxMessage(r, "", &Message{
+		To:      []string{email},
+		Subject: subject,
+		Body: strings.Join(body, "\n\n") +
+			fmt.Sprintf("\n\nYou can change how often you hear from us at %s/settings.", config.BaseURL),
+	}))
+	return true
 }
 
 func capital(s string) string {
@@ -0,0 +1,201 @@
+package storytime
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Returns whether the user may skip, remove or reorder the story's
+// authors, or archive it.
+func canManage(u *User, story Story) bool {
+	return story.Active() && (u.Admin || u.Email == story.Creator)
+}
+
+// Returns whether the user may end the story, i.e. whether it's up to
+// its creator to end it and they can manage it.
+func canEnd(u *User, story Story) bool {
+	return story.EndRule == endByCreator && len(story.Parts) > 0 && canManage(u, story)
+}
+
+// Returns whether the user may delete (or restore) the story.
+func canDelete(u *User, story Story) bool {
+	return u.Admin || u.Email == story.Creator
+}
+
+func newManageForm(r request, u *User, story Story) *manageForm {
+	names := nameFunc(r.store())
+	form := &manageForm{
+		StoryId:        story.Id,
+		NextId:         story.NextId,
+		NextAuthorName: names(story.NextAuthor),
+		CanEnd:         canEnd(u, story),
+	}
+	for _, author := range story.Authors {
+		form.Authors = append(form.Authors, namedAuthor{author, names(author)})
+	}
+	return form
+}
+
+// Returns whether the user may nudge the story's next author, i.e.
+// whether they're one of the other authors.
+func canNudge(u *User, story Story) bool {
+	return story.Active() && u.Email != story.NextAuthor && story.HasAuthor(u.Email)
+}
+
+func newNudgeForm(story Story, user string) *nudgeForm {
+	form := &nudgeForm{StoryId: story.Id, NextId: story.NextId}
+	if next := story.NextNudge(user); next.After(time.Now()) {
+		form.NotUntil = next
+	}
+	return form
+}
+
+// Handles posts to /nudge/storyID, which resend the next author their
+// link to continue, naming the co-author who nudged them.
+func nudge(r request) response {
+	args := r.matchPath("/nudge/:storyId")
+	if args == nil || r.req.Method != "POST" {
+		return notFound
+	}
+	u := r.userRequired()
+	story := r.store().FetchStory((*args)["storyId"])
+	if story == nil || !story.Active() {
+		return errorResponse{404, "Not Found: no such story"}
+	} else if !canNudge(u, *story) {
+		return errorResponse{403, "Forbidden: only the other authors may nudge the next author"}
+	} else if r.req.FormValue("next") != story.NextId {
+		return errorResponse{409, "The story has changed since this page was loaded.  Please go back and reload."}
+	} else if next := story.NextNudge(u.Email); next.After(time.Now()) {
+		return errorResponse{429, "Too many nudges.  You may nudge again " + fuzzyUntil(next) + "."}
+	}
+	story.addEvent(story.NextAuthor, eventNudged, u.Email)
+	r.store().UpdateStory(story, story.NextId, Queued{Outbox: nudgeMail(r, *story, u.Email)})
+	return redirect("/story/" + story.Id)
+}
+
+// Handles posts to /manage/storyID, which let the story's creator (or
+// an admin) skip the next author, remove an author, reorder the
+// authors, archive the story, or end it if that's up to the creator.
+// The form's "next" value must match the story's NextId, so that stale
+// forms don't skip the wrong author.
+func manage(r request) response {
+	args := r.matchPath("/manage/:storyId")
+	if args == nil || r.req.Method != "POST" {
+		return notFound
+	}
+	u := r.userRequired()
+	story := r.store().FetchStory((*args)["storyId"])
+	if story == nil || !story.Active() {
+		return errorResponse{404, "Not Found: no such story"}
+	} else if !canManage(u, *story) {
+		return errorResponse{403, "Forbidden: only the story's creator may manage its authors"}
+	} else if r.req.FormValue("next") != story.NextId {
+		return errorResponse{409, "The story has changed since this page was loaded.  Please go back and reload."}
+	}
+
+	partId := story.NextId
+	oldNext := story.NextAuthor
+	var removed string
+	var err error
+	switch r.req.FormValue("action") {
+	case "skip":
+		story.SkipNextAuthor()
+		story.addEvent(oldNext, eventSkipped, u.Email)
+	case "remove":
+		removed = r.req.FormValue("author")
+		if err = story.RemoveAuthor(removed); err == nil {
+			story.addEvent(removed, eventRemoved, u.Email)
+		}
+	case "reorder":
+		order := SplitterOnAny(",\n\r").TrimResults().OmitEmpty().SplitToList(r.req.FormValue("order"))
+		if err = story.ReorderAuthors(order); err == nil {
+			story.addEvent("", eventReordered, u.Email)
+		}
+	case "archive":
+		story.Archived = true
+		story.addEvent("", eventArchived, u.Email)
+	case "end":
+		if !canEnd(u, *story) {
+			return errorResponse{403, "Forbidden: this story can't be ended yet"}
+		}
+		story.Complete = true
+		story.addEvent("", eventEnded, u.Email)
+	default:
+		return errorResponse{400, "Unknown action"}
+	}
+	if err != nil {
+		return errorResponse{http.StatusBadRequest, err.Error()}
+	}
+
+	// Let the affected authors know.
+	var outbox []OutboxMessage
+	name := nameFunc(r.store())(u.Email)
+	url := config.BaseURL + "/story/" + story.Id
+	if removed != "" {
+		outbox = append(outbox, noticeMail(r, story.Id, removed, "You have been removed from a story.",
+			fmt.Sprintf("%s removed you from the story at %s.", name, url)))
+	} else if story.NextAuthor != oldNext {
+		outbox = append(outbox, noticeMail(r, story.Id, oldNext, "Your turn has been skipped.",
+			fmt.Sprintf("%s skipped your turn in the story at %s.", name, url)))
+	}
+	if story.NextAuthor != oldNext {
+		outbox = append(outbox, maybeTurnMail(r, *story)...)
+	}
+	var deliveries []WebhookDelivery
+	if story.Complete {
+		deliveries = eventDeliveries(r.store(), eventStoryCompleted, *story, "")
+	} else if story.NextAuthor != oldNext {
+		deliveries = eventDeliveries(r.store(), eventTurnAssigned, *story, story.NextAuthor)
+	}
+	r.store().UpdateStory(story, partId, Queued{Outbox: outbox, Deliveries: deliveries})
+	return redirect("/story/" + story.Id)
+}
+
+// Handles posts to /delete/storyID, which let the story's creator (or an
+// admin) delete the story, or restore it until it's purged.
+func deleteStory(r request) response {
+	args := r.matchPath("/delete/:storyId")
+	if args == nil || r.req.Method != "POST" {
+		return notFound
+	}
+	u := r.userRequired()
+	story := r.store().FetchStory((*args)["storyId"])
+	if story == nil {
+		return errorResponse{404, "Not Found: no such story"}
+	} else if !canDelete(u, *story) {
+		return errorResponse{403, "Forbidden: only the story's creator may delete it"}
+	}
+	switch r.req.FormValue("action") {
+	case "delete":
+		if !story.Deleted.IsZero() {
+			return redirect("/story/" + story.Id)
+		}
+		story.addEvent("", eventDeleted, u.Email)
+		story.Deleted = time.Now()
+	case "restore":
+		if story.Deleted.IsZero() {
+			return redirect("/story/" + story.Id)
+		}
+		story.addEvent("", eventRestored, u.Email)
+		story.Deleted = time.Time{}
+	default:
+		return errorResponse{400, "Unknown action"}
+	}
+	r.store().UpdateStory(story, story.NextId, Queued{})
+	return redirect("/story/" + story.Id)
+}
+
+// Task that permanently deletes stories once they can no longer be
+// restored, along with expired login links and sessions, old webhook
+// deliveries and sent messages.
+func purgeDeleted(r request) response {
+	for _, story := range r.store().DeletedStories(time.Now().Add(-deleteUndoWindow)) {
+		r.store().DeleteStory(story.Id)
+	}
+	r.store().PurgeLoginTokens(time.Now())
+	r.store().PurgeSessions(time.Now())
+	r.store().PurgeDeliveries(time.Now().Add(-deliveryLogLifetime))
+	r.store().PurgeOutbox(time.Now().Add(-outboxLifetime))
+	return errorResponse{200, "OK"}
+}
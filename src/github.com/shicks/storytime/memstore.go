@@ -0,0 +1,567 @@
+package storytime
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoryStore that keeps everything in memory, for local development
+// and tests.  Stories are copied on the way in and out so that callers
+// can't modify the stored state behind its back.
+type memoryStore struct {
+	mu      sync.Mutex
+	stories map[string]*Story
+	// StoryAuthor index: author -> set of in-progress story IDs.
+	authors    map[string]map[string]bool
+	users      map[string]UserInfo
+	tokens     map[string]LoginToken
+	sessions   map[string]Session
+	apiTokens  map[string]APIToken
+	webhooks   map[string]Webhook
+	deliveries map[string]WebhookDelivery
+	outbox     map[string]OutboxMessage
+	key        []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		stories:    make(map[string]*Story),
+		authors:    make(map[string]map[string]bool),
+		users:      make(map[string]UserInfo),
+		tokens:     make(map[string]LoginToken),
+		sessions:   make(map[string]Session),
+		apiTokens:  make(map[string]APIToken),
+		webhooks:   make(map[string]Webhook),
+		deliveries: make(map[string]WebhookDelivery),
+		outbox:     make(map[string]OutboxMessage),
+		key:        []byte(randomString(32)),
+	}
+}
+
+// Returns a deep copy of the story.
+func copyStory(story *Story) *Story {
+	c := *story
+	c.Parts = append([]StoryPart(nil), story.Parts...)
+	c.Authors = append([]string(nil), story.Authors...)
+	c.Round = append([]string(nil), story.Round...)
+	c.History = append([]StoryEvent(nil), story.History...)
+	return &c
+}
+
+func (s *memoryStore) CurrentStory(author string) *Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result *Story
+	for _, story := range s.stories {
+		if !story.Active() || story.NextAuthor != author {
+			continue
+		}
+		if result == nil || story.Modified.Before(result.Modified) {
+			result = story
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return copyStory(result)
+}
+
+func (s *memoryStore) InProgressStories(author string) []Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stories := make([]Story, 0, len(s.authors[author]))
+	for id := range s.authors[author] {
+		stories = append(stories, *copyStory(s.stories[id]))
+	}
+	sort.Sort(byTime(stories))
+	return stories
+}
+
+func (s *memoryStore) FetchStory(id string) *Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	story, ok := s.stories[id]
+	if !ok {
+		return nil
+	}
+	return copyStory(story)
+}
+
+func (s *memoryStore) CompletedStories(limit int, olderThan time.Time) []Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stories := make([]Story, 0)
+	for _, story := range s.stories {
+		if story.Complete && story.Deleted.IsZero() && story.Modified.Before(olderThan) {
+			stories = append(stories, *copyStory(story))
+		}
+	}
+	sort.Sort(sort.Reverse(byTime(stories)))
+	if len(stories) > limit {
+		stories = stories[:limit]
+	}
+	return stories
+}
+
+func (s *memoryStore) CompletedStoriesBy(author string, limit int) []Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stories := make([]Story, 0)
+	for _, story := range s.stories {
+		if story.Complete && story.Deleted.IsZero() && story.HasAuthor(author) {
+			stories = append(stories, *copyStory(story))
+		}
+	}
+	sort.Sort(sort.Reverse(byTime(stories)))
+	if len(stories) > limit {
+		stories = stories[:limit]
+	}
+	return stories
+}
+
+func (s *memoryStore) IdleStories(modifiedBefore time.Time) []Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stories := make([]Story, 0)
+	for _, story := range s.stories {
+		if story.Active() && story.Modified.Before(modifiedBefore) {
+			stories = append(stories, *copyStory(story))
+		}
+	}
+	return stories
+}
+
+func (s *memoryStore) DeletedStories(deletedBefore time.Time) []Story {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stories := make([]Story, 0)
+	for _, story := range s.stories {
+		if !story.Deleted.IsZero() && story.Deleted.Before(deletedBefore) {
+			stories = append(stories, *copyStory(story))
+		}
+	}
+	return stories
+}
+
+// Since queue may read the store, it's called before taking the lock.
+func (s *memoryStore) PutNewStory(story *Story, minLength int, queue func(Story) Queued) {
+	id := randomString(32)
+	for i := minLength; i < len(id); i++ {
+		story.Id = id[:i]
+		queued := queue(*story)
+		s.mu.Lock()
+		if _, taken := s.stories[story.Id]; taken {
+			s.mu.Unlock()
+			continue
+		}
+		s.stories[story.Id] = copyStory(story)
+		for _, author := range story.Authors {
+			if s.authors[author] == nil {
+				s.authors[author] = make(map[string]bool)
+			}
+			s.authors[author][story.Id] = true
+		}
+		s.putQueued(queued)
+		s.mu.Unlock()
+		return
+	}
+	story.Id = ""
+	panic(&appError{errKeyTaken, "Failed to put story in memory store", http.StatusInternalServerError})
+}
+
+// Saves queued messages and deliveries.  The caller holds the lock.
+func (s *memoryStore) putQueued(queued Queued) {
+	for _, m := range queued.Outbox {
+		s.putOutboxMessage(m)
+	}
+	for _, d := range queued.Deliveries {
+		s.deliveries[d.Id] = d
+	}
+}
+
+func (s *memoryStore) UpdateStory(story *Story, partId string, queued Queued) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.stories[story.Id]
+	if !ok {
+		panic(&appError{errNoSuchStory, "Failed to update story", http.StatusInternalServerError})
+	}
+	if existing.NextId != partId {
+		panic(&appError{errConcurrentPart, errConcurrentPart.Error(), http.StatusConflict})
+	}
+	s.stories[story.Id] = copyStory(story)
+	for _, author := range existing.Authors {
+		delete(s.authors[author], story.Id)
+	}
+	if story.Active() {
+		for _, author := range story.Authors {
+			if s.authors[author] == nil {
+				s.authors[author] = make(map[string]bool)
+			}
+			s.authors[author][story.Id] = true
+		}
+	}
+	s.putQueued(queued)
+}
+
+func (s *memoryStore) DeleteStory(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if story, ok := s.stories[id]; ok {
+		for _, author := range story.Authors {
+			delete(s.authors[author], id)
+		}
+		delete(s.stories, id)
+	}
+}
+
+func (s *memoryStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stories = make(map[string]*Story)
+	s.authors = make(map[string]map[string]bool)
+	s.users = make(map[string]UserInfo)
+	s.tokens = make(map[string]LoginToken)
+	s.sessions = make(map[string]Session)
+	s.apiTokens = make(map[string]APIToken)
+	s.webhooks = make(map[string]Webhook)
+	s.deliveries = make(map[string]WebhookDelivery)
+	s.outbox = make(map[string]OutboxMessage)
+}
+
+func (s *memoryStore) GetName(email string) *string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.users[email]
+	if !ok || info.Name == "" {
+		return nil
+	}
+	name := info.Name
+	return &name
+}
+
+func (s *memoryStore) PutName(name, email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.users[email]
+	info.Email = email
+	info.Name = name
+	s.users[email] = info
+}
+
+func (s *memoryStore) GetUserInfo(email string) *UserInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.users[email]
+	if !ok {
+		return nil
+	}
+	return &info
+}
+
+func (s *memoryStore) PutUserInfo(info UserInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[info.Email] = info
+}
+
+func (s *memoryStore) DigestUsers() []UserInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]UserInfo, 0)
+	for _, info := range s.users {
+		if info.Notify == notifyDigest {
+			users = append(users, info)
+		}
+	}
+	return users
+}
+
+func (s *memoryStore) PutLoginToken(token LoginToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Id] = token
+}
+
+func (s *memoryStore) TakeLoginToken(id string) *LoginToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil
+	}
+	delete(s.tokens, id)
+	return &token
+}
+
+func (s *memoryStore) HasLoginToken(email string, expiresAfter time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokens {
+		if token.Email == email && token.Expires.After(expiresAfter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) PurgeLoginTokens(expiredBefore time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, token := range s.tokens {
+		if token.Expires.Before(expiredBefore) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+func (s *memoryStore) PutSession(session Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.Id] = session
+}
+
+func (s *memoryStore) GetSession(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	return &session
+}
+
+func (s *memoryStore) UserSessions(email string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]Session, 0)
+	for _, session := range s.sessions {
+		if session.Email == email {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Sort(byLastSeen(sessions))
+	return sessions
+}
+
+func (s *memoryStore) DeleteSession(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+func (s *memoryStore) PurgeSessions(expiredBefore time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, session := range s.sessions {
+		if session.Expires.Before(expiredBefore) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *memoryStore) PutAPIToken(token APIToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiTokens[token.Hash] = token
+}
+
+func (s *memoryStore) GetAPIToken(hash string) *APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.apiTokens[hash]
+	if !ok {
+		return nil
+	}
+	return &token
+}
+
+func (s *memoryStore) UserAPITokens(email string) []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tokens := make([]APIToken, 0)
+	for _, token := range s.apiTokens {
+		if token.Email == email {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens
+}
+
+func (s *memoryStore) DeleteAPIToken(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.apiTokens, hash)
+}
+
+func (s *memoryStore) PutWebhook(hook Webhook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook.Events = append([]string(nil), hook.Events...)
+	s.webhooks[hook.Id] = hook
+}
+
+func (s *memoryStore) GetWebhook(id string) *Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook, ok := s.webhooks[id]
+	if !ok {
+		return nil
+	}
+	hook.Events = append([]string(nil), hook.Events...)
+	return &hook
+}
+
+func (s *memoryStore) UserWebhooks(email string) []Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks := make([]Webhook, 0)
+	for _, hook := range s.webhooks {
+		if hook.Email == email {
+			hook.Events = append([]string(nil), hook.Events...)
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Sort(webhooksByCreated(hooks))
+	return hooks
+}
+
+func (s *memoryStore) DeleteWebhook(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.webhooks, id)
+	for deliveryId, d := range s.deliveries {
+		if d.WebhookId == id {
+			delete(s.deliveries, deliveryId)
+		}
+	}
+}
+
+func (s *memoryStore) PutDelivery(d WebhookDelivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[d.Id] = d
+}
+
+func (s *memoryStore) DueDeliveries(due time.Time, limit int) []WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.State == deliveryPending && !d.NextAttempt.After(due) {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Sort(deliveriesByNextAttempt(deliveries))
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
+
+func (s *memoryStore) WebhookDeliveries(webhookId string, limit int) []WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0)
+	for _, d := range s.deliveries {
+		if d.WebhookId == webhookId {
+			deliveries = append(deliveries, d)
+		}
+	}
+	sort.Sort(deliveriesByCreated(deliveries))
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
+
+func (s *memoryStore) PurgeDeliveries(createdBefore time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, d := range s.deliveries {
+		if d.State != deliveryPending && d.Created.Before(createdBefore) {
+			delete(s.deliveries, id)
+		}
+	}
+}
+
+func (s *memoryStore) PutOutboxMessage(m OutboxMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putOutboxMessage(m)
+}
+
+// Like PutOutboxMessage, but with the lock already held.
+func (s *memoryStore) putOutboxMessage(m OutboxMessage) {
+	m.To = append([]string(nil), m.To...)
+	s.outbox[m.Id] = m
+}
+
+func (s *memoryStore) GetOutboxMessage(id string) *OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.outbox[id]
+	if !ok {
+		return nil
+	}
+	return &m
+}
+
+func (s *memoryStore) DeleteOutboxMessage(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.outbox, id)
+}
+
+func (s *memoryStore) DueOutboxMessages(due time.Time, limit int) []OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]OutboxMessage, 0)
+	for _, m := range s.outbox {
+		if m.State == outboxPending && !m.NextAttempt.After(due) {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Sort(outboxByNextAttempt(msgs))
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs
+}
+
+func (s *memoryStore) DeadOutboxMessages(limit int) []OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]OutboxMessage, 0)
+	for _, m := range s.outbox {
+		if m.State == outboxDead {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Sort(outboxByLastAttempt(msgs))
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs
+}
+
+func (s *memoryStore) PurgeOutbox(createdBefore time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, m := range s.outbox {
+		if m.State == outboxSent && m.Created.Before(createdBefore) {
+			delete(s.outbox, id)
+		}
+	}
+}
+
+// The key only lasts as long as the stories do.
+func (s *memoryStore) SigningKey() []byte {
+	return s.key
+}
+
+// Nothing is cached outside the maps themselves.
+func (s *memoryStore) FlushUserCache() {}
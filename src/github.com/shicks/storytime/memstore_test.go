@@ -0,0 +1,36 @@
+package storytime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreCopiesStories(t *testing.T) {
+	st := newMemoryStore()
+	story := Story{NextId: "p2", NextAuthor: "b@x.com", Authors: []string{"a@x.com", "b@x.com"},
+		Parts: []StoryPart{{Id: "p1", Visible: "Once", Written: time.Now(), Author: "a@x.com"}}}
+	st.PutNewStory(&story, 8, func(Story) Queued { return Queued{} })
+	if story.Id == "" {
+		t.Fatalf("PutNewStory didn't fill in the ID")
+	}
+
+	// Changing the caller's copies doesn't change what's stored.
+	story.Authors[0] = "changed"
+	story.Parts[0].Visible = "changed"
+	fetched := st.FetchStory(story.Id)
+	fetched.Authors[1] = "changed"
+	fetched.Parts = append(fetched.Parts, StoryPart{Id: "p2"})
+	for _, s := range []*Story{st.FetchStory(story.Id), st.CurrentStory("b@x.com")} {
+		if s == nil {
+			t.Fatalf("story is no longer stored as b@x.com's current story")
+		}
+		if s.Authors[0] != "a@x.com" || s.Authors[1] != "b@x.com" || len(s.Parts) != 1 || s.Parts[0].Visible != "Once" {
+			t.Errorf("stored story changed: %+v", *s)
+		}
+	}
+
+	st.DeleteStory(story.Id)
+	if st.FetchStory(story.Id) != nil || len(st.InProgressStories("a@x.com")) != 0 {
+		t.Errorf("DeleteStory left the story or its author index behind")
+	}
+}
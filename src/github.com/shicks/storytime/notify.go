@@ -0,0 +1,96 @@
+package storytime
+
+// Notifiers deliver the emails and chat messages that tell users about
+// their turns.  App Engine uses its own mail and XMPP services; a
+// standalone server can send mail over SMTP, or write everything to a
+// file (or stdout) for development.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An outgoing email, independent of how it's delivered.  It's sent from
+// Config.Sender.
+type Message struct {
+	To      []string
+	ReplyTo string
+	Subject string
+	Body    string
+	// What to send instead to users who get their turns by chat, if
+	// this is a turn message.
+	Chat string
+}
+
+// A Notifier sends messages to users.
+type Notifier interface {
+	// Sends an email.
+	SendMail(r *http.Request, msg *Message) error
+	// Sends a chat message to the given address.
+	SendChat(r *http.Request, to, text string) error
+	// Returns whether SendChat can send anything, so that users may
+	// choose to get their turns by chat.
+	CanChat() bool
+}
+
+// Returned by notifiers that can't send chat messages.
+var errNoChat = errors.New("Chat messages are not supported")
+
+// Notifier that writes each message to w, for development.
+type fileNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Returns a Notifier that writes messages to w instead of sending them.
+func NewFileNotifier(w io.Writer) Notifier {
+	return &fileNotifier{w: w}
+}
+
+func (n *fileNotifier) SendMail(r *http.Request, msg *Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.w, "--- Mail at %s\nFrom: %s\nTo: %s\nReply-To: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC3339), config.Sender, strings.Join(msg.To, ", "), msg.ReplyTo, msg.Subject, msg.Body)
+	return err
+}
+
+func (n *fileNotifier) SendChat(r *http.Request, to, text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.w, "--- Chat at %s\nTo: %s\n\n%s\n\n", time.Now().Format(time.RFC3339), to, text)
+	return err
+}
+
+func (n *fileNotifier) CanChat() bool {
+	return true
+}
+
+// Notifier that sends chat messages through a Matrix homeserver, and
+// everything else through another Notifier.
+type matrixNotifier struct {
+	Notifier
+	server string
+	token  string
+}
+
+// Returns a Notifier that sends chat messages to Matrix rooms through
+// the homeserver at the given URL (or anything speaking the same
+// client-server API), as the account with the given access token.  Mail
+// is still sent by n.
+func WithMatrixChat(n Notifier, server, token string) Notifier {
+	return &matrixNotifier{n, strings.TrimSuffix(server, "/"), token}
+}
+
+func (n *matrixNotifier) SendChat(r *http.Request, room, text string) error {
+	return sendMatrix(host.httpClient(r), n.server, n.token, room, text)
+}
+
+func (n *matrixNotifier) CanChat() bool {
+	return true
+}
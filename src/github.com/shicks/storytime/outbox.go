@@ -0,0 +1,200 @@
+package storytime
+
+// The outbox: emails and chat messages are queued in the store instead
+// of being sent while handling the request, so that a failure to send
+// can't undo (or abort halfway through) the change they're about.
+// Messages about a story update are written by UpdateStory, in the same
+// transaction as the story.  The /tasks/outbox task sends them, retrying
+// failures with exponential backoff; messages that still can't be sent
+// are dead-lettered and shown to admins at /admin/outbox.
+
+import (
+	"strings"
+	"time"
+)
+
+// Kinds of outbox message.
+const (
+	outboxMail = "mail"
+	outboxChat = "chat"
+)
+
+// Outbox message states.
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+)
+
+const (
+	// Most messages sent by one run of the task.
+	outboxBatchSize = 50
+	// Attempts before a message is dead-lettered.  With the delay
+	// doubling from a minute, the last is about two hours after the first.
+	maxOutboxAttempts = 8
+	// How long sent messages are kept.
+	outboxLifetime = week
+	// Most dead messages shown to admins.
+	deadOutboxLength = 100
+)
+
+// A queued email or chat message.
+type OutboxMessage struct {
+	Id string
+	// The story whose update queued the message, or "".
+	StoryId string
+	// outboxMail or outboxChat.
+	Kind string
+	// The recipients: email addresses, or for chat the one chat address.
+	To      []string
+	ReplyTo string
+	// Empty for chat messages.
+	Subject string
+	Body    string `datastore:",noindex"`
+	// When the message was queued.
+	Created time.Time
+	// One of outboxPending, outboxSent or outboxDead.
+	State string
+	// How many times sending has been tried.
+	Attempts int
+	// When to try next, while pending.
+	NextAttempt time.Time
+	// When it was last tried, or the zero time.
+	LastAttempt time.Time
+	// Why the last attempt failed, or "".
+	Error string `datastore:",noindex"`
+}
+
+// Sorts outbox messages by LastAttempt, most recent first.
+type outboxByLastAttempt []OutboxMessage
+
+func (a outboxByLastAttempt) Len() int      { return len(a) }
+func (a outboxByLastAttempt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a outboxByLastAttempt) Less(i, j int) bool {
+	return a[i].LastAttempt.After(a[j].LastAttempt)
+}
+
+// Sorts outbox messages by NextAttempt, soonest first.
+type outboxByNextAttempt []OutboxMessage
+
+func (a outboxByNextAttempt) Len() int      { return len(a) }
+func (a outboxByNextAttempt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a outboxByNextAttempt) Less(i, j int) bool {
+	return a[i].NextAttempt.Before(a[j].NextAttempt)
+}
+
+// Makes the outbox message for an email about the given story (or "").
+// Turn messages go by chat instead to users who've asked for that.
+func outboxMessage(r request, storyId string, msg *Message) OutboxMessage {
+	now := time.Now()
+	m := OutboxMessage{
+		Id:          randomString(16),
+		StoryId:     storyId,
+		Kind:        outboxMail,
+		To:          msg.To,
+		ReplyTo:     msg.ReplyTo,
+		Subject:     msg.Subject,
+		Body:        msg.Body,
+		Created:     now,
+		State:       outboxPending,
+		NextAttempt: now,
+	}
+	if msg.Chat != "" {
+		if to := chatAddress(r.store(), msg.To[0]); to != "" {
+			m.Kind = outboxChat
+			m.To = []string{to}
+			m.ReplyTo = ""
+			m.Subject = ""
+			m.Body = msg.Chat
+		}
+	}
+	return m
+}
+
+// Queues messages that aren't part of a story update.
+func queueMessages(r request, msgs ...OutboxMessage) {
+	for _, m := range msgs {
+		r.store().PutOutboxMessage(m)
+	}
+}
+
+// How long to wait after the given number of failed attempts.
+func outboxRetryDelay(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// Task that sends the messages that are due.
+func drainOutbox(r request) response {
+	now := time.Now()
+	for _, m := range r.store().DueOutboxMessages(now, outboxBatchSize) {
+		sendOutboxMessage(r, m, now)
+	}
+	return errorResponse{200, "OK"}
+}
+
+// Tries to send one message, and records how it went.
+func sendOutboxMessage(r request, m OutboxMessage, now time.Time) {
+	m.Attempts++
+	m.LastAttempt = now
+	var err error
+	if m.Kind == outboxChat {
+		err = config.Notifier.SendChat(r.req, m.To[0], m.Body)
+	} else {
+		err = config.Notifier.SendMail(r.req, &Message{To: m.To, ReplyTo: m.ReplyTo, Subject: m.Subject, Body: m.Body})
+	}
+	m.Error = ""
+	if err == nil {
+		m.State = outboxSent
+	} else {
+		m.Error = err.Error()
+		r.errorf("Couldn't send %s to %v (attempt %d): %v", m.Kind, m.To, m.Attempts, err)
+		if m.Attempts >= maxOutboxAttempts {
+			m.State = outboxDead
+		}
+	}
+	if m.State == outboxPending {
+		m.NextAttempt = now.Add(outboxRetryDelay(m.Attempts))
+	} else {
+		m.NextAttempt = time.Time{}
+	}
+	r.store().PutOutboxMessage(m)
+}
+
+// Handles /admin/outbox, where admins see the dead-lettered messages,
+// and retry or discard them.
+func outboxAdmin(r request) response {
+	if r.matchPath("/admin/outbox") == nil {
+		return notFound
+	}
+	u := r.userRequired()
+	if !u.Admin {
+		return notFound
+	}
+	if r.req.Method == "POST" {
+		m := r.store().GetOutboxMessage(r.req.FormValue("id"))
+		if m == nil || m.State != outboxDead {
+			return errorResponse{404, "Not Found: no such dead message"}
+		}
+		switch r.req.FormValue("action") {
+		case "retry":
+			m.State = outboxPending
+			m.Attempts = 0
+			m.NextAttempt = time.Now()
+			r.store().PutOutboxMessage(*m)
+		case "discard":
+			r.store().DeleteOutboxMessage(m.Id)
+		default:
+			return errorResponse{400, "Unknown action"}
+		}
+		return redirect("/admin/outbox")
+	}
+	return execute(&outboxPage{r.store().DeadOutboxMessages(deadOutboxLength)})
+}
+
+// Describes a message's recipients, for the admin page.
+func (m OutboxMessage) Recipients() string {
+	if m.Kind == outboxChat {
+		return "chat " + m.To[0]
+	}
+	return strings.Join(m.To, ", ")
+}
@@ -0,0 +1,72 @@
+package storytime
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{maxOutboxAttempts - 1, 64 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := outboxRetryDelay(test.attempts); got != test.want {
+			t.Errorf("outboxRetryDelay(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestSendOutboxMessage(t *testing.T) {
+	st, n := setUpTest(nil)
+	now := time.Now()
+	r := newTestRequest("POST", "/tasks/outbox", nil)
+	tests := []struct {
+		name     string
+		kind     string
+		attempts int
+		err      error
+		// What the message should be left as.
+		state     string
+		nextDelay time.Duration
+	}{
+		{"mail", outboxMail, 0, nil, outboxSent, 0},
+		{"chat", outboxChat, 0, nil, outboxSent, 0},
+		{"failed", outboxMail, 0, errors.New("no route"), outboxPending, time.Minute},
+		{"failed again", outboxChat, 2, errors.New("no route"), outboxPending, 4 * time.Minute},
+		{"dead", outboxMail, maxOutboxAttempts - 1, errors.New("no route"), outboxDead, 0},
+		{"sent at last", outboxMail, maxOutboxAttempts - 1, nil, outboxSent, 0},
+	}
+	for _, test := range tests {
+		n.err = test.err
+		n.mail, n.chats = nil, nil
+		m := OutboxMessage{Id: randomString(8), Kind: test.kind, To: []string{"a@x.com"}, Subject: "Hi", Body: "Hello",
+			Created: now, State: outboxPending, Attempts: test.attempts, NextAttempt: now}
+		sendOutboxMessage(r, m, now)
+		got := st.GetOutboxMessage(m.Id)
+		if got == nil {
+			t.Errorf("%s: message wasn't saved", test.name)
+			continue
+		}
+		if got.State != test.state || got.Attempts != test.attempts+1 {
+			t.Errorf("%s: message is %s after %d attempts, want %s after %d",
+				test.name, got.State, got.Attempts, test.state, test.attempts+1)
+		}
+		if (got.Error != "") != (test.err != nil) {
+			t.Errorf("%s: error = %q", test.name, got.Error)
+		}
+		if test.nextDelay == 0 && !got.NextAttempt.IsZero() || test.nextDelay != 0 && !got.NextAttempt.Equal(now.Add(test.nextDelay)) {
+			t.Errorf("%s: next attempt in %v, want %v", test.name, got.NextAttempt.Sub(now), test.nextDelay)
+		}
+		if sent := len(n.mail) + len(n.chats); test.err == nil && sent != 1 {
+			t.Errorf("%s: sent %d messages", test.name, sent)
+		} else if test.kind == outboxChat && test.err == nil && len(n.chats) != 1 {
+			t.Errorf("%s: sent as mail instead of chat", test.name)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package storytime
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Config holds the settings that differ between deployments.
+type Config struct {
+	// Public URL of the server, without a trailing slash, used to
+	// build the links sent in emails.
+	BaseURL string
+	// Address that notification emails are sent from.
+	Sender string
+	// Domain that receives replies to notification emails, which are
+	// then posted to /_ah/mail/.  Replies are disabled if empty.
+	ReplyDomain string
+	// Secret that a standalone server's mail gateway must send in the
+	// X-Storytime-Mail-Secret header when posting to /_ah/mail/.  If
+	// empty, a standalone server accepts no replies.  On App Engine,
+	// app.yaml only lets the mail service post there.
+	MailSecret string
+	// Directory containing template.html and the static files.
+	ResourceDir string
+	// How emails and chat messages are sent.
+	Notifier Notifier
+}
+
+// A platform supplies the services that differ between App Engine and
+// a standalone server.
+type platform interface {
+	// Returns the StoryStore to use for the given request.
+	store(r *http.Request) StoryStore
+	// Returns the user logged in with the platform's own accounts, or nil.
+	user(r *http.Request) *User
+	// Returns whether the user with the given email, signed in with a
+	// session rather than the platform's accounts, may use the admin
+	// handlers.
+	admin(email string) bool
+	// Returns the URL of the platform's own login page, which should
+	// then send the user on to dest, or "" if there isn't one.
+	loginURL(r *http.Request, dest string) string
+	// Returns the URL that logs the user out of the platform's accounts.
+	logoutURL(r *http.Request) string
+	// Returns a client for making outgoing HTTP requests, such as to the
+	// chat server.
+	httpClient(r *http.Request) *http.Client
+	// Returns a client for delivering webhooks, which can only reach
+	// public addresses.
+	webhookClient(r *http.Request) *http.Client
+	// Logs an error.
+	errorf(r *http.Request, format string, args ...interface{})
+	// Returns whether the request was made by the platform's scheduler.
+	isTask(r *http.Request) bool
+	// Returns whether the request was posted by the platform's inbound
+	// mail service.
+	isMail(r *http.Request) bool
+}
+
+// Background tasks, keyed by path.  These are run periodically by
+// cron.yaml on App Engine, and by RunScheduledTasks on a standalone server.
+var scheduledTasks = map[string]appHandler{
+	"/tasks/timeouts": checkTimeouts,
+	"/tasks/purge":    purgeDeleted,
+	"/tasks/digest":   sendDigests,
+}
+
+// Tasks that send queued messages, which need to run more often: every
+// minute on App Engine, and every interval given to RunDeliveryTasks on
+// a standalone server.
+var deliveryTasks = map[string]appHandler{
+	"/tasks/outbox":   drainOutbox,
+	"/tasks/webhooks": deliverWebhooks,
+}
+
+// Only lets the platform's scheduler run the task.
+func taskHandler(task appHandler) appHandler {
+	return func(r request) response {
+		if !host.isTask(r.req) {
+			return notFound
+		}
+		return task(r)
+	}
+}
+
+// The current user.
+type User struct {
+	// The user's email address.
+	Email string
+	// Whether the user may use the admin handlers.
+	Admin bool
+}
+
+var (
+	config Config
+	host   platform
+)
+
+// Registers all the storytime handlers on the given mux.
+func register(mux *http.ServeMux, cfg Config, p platform) {
+	config = cfg
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	host = p
+	loadTemplates(cfg.ResourceDir)
+
+	mux.Handle("/", appHandler(root))
+	mux.Handle("/begin", appHandler(begin))
+	mux.Handle("/completed", appHandler(completed))
+	mux.Handle("/completed.atom", appHandler(completedFeed))
+	mux.Handle("/story/", appHandler(story))
+	mux.Handle("/write/", appHandler(write))
+	mux.Handle("/manage/", appHandler(manage))
+	mux.Handle("/nudge/", appHandler(nudge))
+	mux.Handle("/delete/", appHandler(deleteStory))
+	mux.Handle("/settings", appHandler(settings))
+	mux.Handle("/settings/sessions", appHandler(sessions))
+	mux.Handle("/settings/tokens", appHandler(apiTokens))
+	mux.Handle("/settings/webhooks", appHandler(webhooks))
+	mux.Handle("/signin", appHandler(signin))
+	mux.Handle("/signin/verify", appHandler(verifySignin))
+	mux.Handle("/signout", appHandler(signout))
+	mux.Handle("/_ah/mail/", uncheckedHandler(receiveMail))
+	mux.Handle("/api/v1/", apiHandler(api))
+
+	for path, task := range scheduledTasks {
+		mux.Handle(path, uncheckedHandler(taskHandler(task)))
+	}
+	for path, task := range deliveryTasks {
+		mux.Handle(path, uncheckedHandler(taskHandler(task)))
+	}
+
+	// TODO(sdh): remove this handler in prod
+	mux.Handle("/clear", appHandler(clearAll))
+	mux.Handle("/repair", appHandler(repairAll))
+	mux.Handle("/admin/outbox", appHandler(outboxAdmin))
+}
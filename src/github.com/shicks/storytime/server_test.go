@@ -0,0 +1,79 @@
+package storytime
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+// Platform for tests: one store, and an optional platform user.
+type testPlatform struct {
+	st StoryStore
+	u  *User
+}
+
+func (p *testPlatform) store(r *http.Request) StoryStore                           { return p.st }
+func (p *testPlatform) user(r *http.Request) *User                                 { return p.u }
+func (p *testPlatform) admin(email string) bool                                    { return false }
+func (p *testPlatform) loginURL(r *http.Request, dest string) string               { return "" }
+func (p *testPlatform) logoutURL(r *http.Request) string                           { return "/" }
+func (p *testPlatform) httpClient(r *http.Request) *http.Client                    { return http.DefaultClient }
+func (p *testPlatform) webhookClient(r *http.Request) *http.Client                 { return http.DefaultClient }
+func (p *testPlatform) errorf(r *http.Request, format string, args ...interface{}) {}
+func (p *testPlatform) isTask(r *http.Request) bool                                { return true }
+func (p *testPlatform) isMail(r *http.Request) bool                                { return true }
+
+// Notifier for tests that records what it's asked to send, and fails
+// with err if it's set.
+type testNotifier struct {
+	mail  []*Message
+	chats []string
+	err   error
+}
+
+func (n *testNotifier) SendMail(r *http.Request, msg *Message) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.mail = append(n.mail, msg)
+	return nil
+}
+
+func (n *testNotifier) SendChat(r *http.Request, to, text string) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.chats = append(n.chats, to+": "+text)
+	return nil
+}
+
+func (n *testNotifier) CanChat() bool {
+	return true
+}
+
+// Points the package at a fresh memory store, with u (if any) signed in
+// through the platform, and returns the notifier messages are sent with.
+func setUpTest(u *User) (*memoryStore, *testNotifier) {
+	st := newMemoryStore()
+	n := &testNotifier{}
+	config = Config{BaseURL: "http://storytime.test", Sender: "storytime@storytime.test", Notifier: n}
+	host = &testPlatform{st, u}
+	return st, n
+}
+
+// Returns a request for the given method and path, posting the form (if
+// any), with the given cookies.
+func newTestRequest(method, path string, form url.Values, cookies ...*http.Cookie) request {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return newRequest(req)
+}
@@ -0,0 +1,150 @@
+package storytime
+
+// Sessions for users who logged in with an emailed link.  The cookie
+// only holds a signed session ID; the session itself is stored, so that
+// it can be listed and revoked from /settings/sessions.
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "storytime-session"
+	// How long a login lasts.
+	sessionLifetime = 30 * day
+	// How often LastSeen is updated, to save a write on every request.
+	sessionTouchInterval = 10 * time.Minute
+	// Longer user agents are truncated.
+	maxUserAgent = 200
+)
+
+// A logged-in browser.
+type Session struct {
+	// Random ID, which is also the key.
+	Id string
+	// The logged-in user's email address.
+	Email string
+	// When the user logged in.
+	Created time.Time
+	// When the session was last used (to within sessionTouchInterval).
+	LastSeen time.Time
+	// When the session stops working.
+	Expires time.Time
+	// The browser's user agent when the session was last seen.
+	UserAgent string
+	// A hash of the IP address the session was last seen from, so that
+	// users can tell their devices apart without us storing addresses.
+	IPHash string
+}
+
+// Sorts sessions by LastSeen, most recent first.
+type byLastSeen []Session
+
+func (a byLastSeen) Len() int           { return len(a) }
+func (a byLastSeen) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byLastSeen) Less(i, j int) bool { return a[i].LastSeen.After(a[j].LastSeen) }
+
+// Records the requesting browser's details in the session.
+func (s *Session) touch(r request, now time.Time) {
+	s.LastSeen = now
+	s.UserAgent = r.req.UserAgent()
+	if len(s.UserAgent) > maxUserAgent {
+		s.UserAgent = s.UserAgent[:maxUserAgent]
+	}
+	ip, _, err := net.SplitHostPort(r.req.RemoteAddr)
+	if err != nil {
+		ip = r.req.RemoteAddr
+	}
+	s.IPHash = sign(r.store(), "ip", ip)[:12]
+}
+
+// Starts a session for the given email, returning its cookie.
+func newSession(r request, email string) *http.Cookie {
+	now := time.Now()
+	session := Session{
+		Id:      randomString(32),
+		Email:   email,
+		Created: now,
+		Expires: now.Add(sessionLifetime),
+	}
+	session.touch(r, now)
+	r.store().PutSession(session)
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    session.Id + "." + sign(r.store(), "session", session.Id),
+		Path:     "/",
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.BaseURL, "https:"),
+	}
+}
+
+// Returns the session ID from a validly signed cookie, or "".
+func sessionId(r request) string {
+	c, err := r.req.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Split(c.Value, ".")
+	if len(fields) != 2 || !validSignature(r.store(), fields[1], "session", fields[0]) {
+		return ""
+	}
+	return fields[0]
+}
+
+// Returns the user logged in by the session cookie, or nil if there
+// isn't one, or it's been revoked or has expired.
+func sessionUser(r request) *User {
+	id := sessionId(r)
+	if id == "" {
+		return nil
+	}
+	session := r.store().GetSession(id)
+	if session == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.After(session.Expires) {
+		r.store().DeleteSession(id)
+		return nil
+	}
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		session.touch(r, now)
+		r.store().PutSession(*session)
+	}
+	return &User{Email: session.Email, Admin: host.admin(session.Email)}
+}
+
+// Handles /settings/sessions, which lists the user's sessions and lets
+// them revoke any of them.
+func sessions(r request) response {
+	if r.matchPath("/settings/sessions") == nil {
+		return notFound
+	}
+	u := r.userRequired()
+	current := sessionId(r)
+	if r.req.Method != "POST" {
+		return execute(&sessionsPage{r.store().UserSessions(u.Email), current})
+	}
+
+	switch r.req.FormValue("action") {
+	case "revoke":
+		session := r.store().GetSession(r.req.FormValue("id"))
+		if session == nil || session.Email != u.Email {
+			return errorResponse{404, "Not Found: no such session"}
+		}
+		r.store().DeleteSession(session.Id)
+	case "revokeOthers":
+		for _, session := range r.store().UserSessions(u.Email) {
+			if session.Id != current {
+				r.store().DeleteSession(session.Id)
+			}
+		}
+	default:
+		return errorResponse{400, "Unknown action"}
+	}
+	return redirect("/settings/sessions")
+}
@@ -0,0 +1,40 @@
+package storytime
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSessionUser(t *testing.T) {
+	st, _ := setUpTest(nil)
+	cookie := newSession(newTestRequest("GET", "/", nil), "a@x.com")
+	if u := sessionUser(newTestRequest("GET", "/", nil, cookie)); u == nil || u.Email != "a@x.com" {
+		t.Fatalf("sessionUser = %v, want a@x.com", u)
+	}
+	if u := sessionUser(newTestRequest("GET", "/", nil)); u != nil {
+		t.Errorf("sessionUser without a cookie = %v", u)
+	}
+
+	id := sessionId(newTestRequest("GET", "/", nil, cookie))
+	forged := &http.Cookie{Name: sessionCookie, Value: id + "." + sign(newMemoryStore(), "session", id)}
+	if u := sessionUser(newTestRequest("GET", "/", nil, forged)); u != nil {
+		t.Errorf("sessionUser with a forged cookie = %v", u)
+	}
+
+	session := st.GetSession(id)
+	session.Expires = time.Now().Add(-time.Minute)
+	st.PutSession(*session)
+	if u := sessionUser(newTestRequest("GET", "/", nil, cookie)); u != nil {
+		t.Errorf("sessionUser with an expired session = %v", u)
+	}
+	if st.GetSession(id) != nil {
+		t.Errorf("expired session wasn't deleted")
+	}
+
+	cookie = newSession(newTestRequest("GET", "/", nil), "a@x.com")
+	st.DeleteSession(sessionId(newTestRequest("GET", "/", nil, cookie)))
+	if u := sessionUser(newTestRequest("GET", "/", nil, cookie)); u != nil {
+		t.Errorf("sessionUser with a revoked session = %v", u)
+	}
+}
@@ -0,0 +1,40 @@
+package storytime
+
+import (
+	"strings"
+)
+
+// Handles /settings, where users set their name and how they want to be
+// told that it's their turn.  Chat is only offered if the Notifier can
+// send it; otherwise chat users get email.
+func settings(r request) response {
+	if r.matchPath("/settings") == nil {
+		return notFound
+	}
+	u := r.userRequired()
+	info := r.store().GetUserInfo(u.Email)
+	if info == nil {
+		info = &UserInfo{Email: u.Email}
+	}
+	if r.req.Method != "POST" {
+		return execute(&settingsPage{Info: *info, Saved: r.req.FormValue("saved") != "", CanChat: config.Notifier.CanChat()})
+	}
+
+	switch notify := r.req.FormValue("notify"); notify {
+	case notifyImmediate, notifyDigest, notifyNone, notifyChat:
+		info.Notify = notify
+	default:
+		return errorResponse{400, "Bad Request: unknown notification preference"}
+	}
+	info.Name = strings.TrimSpace(r.req.FormValue("name"))
+	if config.Notifier.CanChat() {
+		info.Chat = strings.TrimSpace(r.req.FormValue("chat"))
+	} else if info.Notify == notifyChat {
+		return errorResponse{400, "Bad Request: this server can't send chat messages"}
+	}
+	if info.Notify == notifyChat && info.Chat == "" {
+		return errorResponse{400, "Bad Request: enter a chat address to get chat messages"}
+	}
+	r.store().PutUserInfo(*info)
+	return redirect("/settings?saved=1")
+}
@@ -0,0 +1,62 @@
+//go:build !appengine
+// +build !appengine
+
+package storytime
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier that sends mail through an SMTP server.
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+}
+
+// Returns a Notifier that sends mail through the SMTP server at addr
+// (host:port), logging in with the given username and password unless
+// the username is empty.  It can't send chat messages; see WithMatrixChat.
+func NewSMTPNotifier(addr, username, password string) Notifier {
+	n := &smtpNotifier{addr: addr}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		n.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return n
+}
+
+func (n *smtpNotifier) SendMail(r *http.Request, msg *Message) error {
+	from, err := mail.ParseAddress(config.Sender)
+	if err != nil {
+		return fmt.Errorf("Bad sender address %q: %v", config.Sender, err)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(msg.To, ", "))
+	if msg.ReplyTo != "" {
+		fmt.Fprintf(&b, "Reply-To: %s\r\n", msg.ReplyTo)
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return smtp.SendMail(n.addr, n.auth, from.Address, msg.To, b.Bytes())
+}
+
+func (n *smtpNotifier) SendChat(r *http.Request, to, text string) error {
+	return errNoChat
+}
+
+// Chat needs WithMatrixChat.
+func (n *smtpNotifier) CanChat() bool {
+	return false
+}
@@ -0,0 +1,1010 @@
+//go:build !appengine
+// +build !appengine
+
+package storytime
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Schema migrations, applied in order at startup.  The schema version
+// recorded in the database is the number of migrations applied so far,
+// so existing entries must never be changed: add a new one instead.
+var migrations = [][]string{
+	// 1: Initial schema.  Story.Authors and Story.Parts are normalized
+	// into their own tables, keyed by position to preserve their order.
+	{
+		`CREATE TABLE stories (
+			id          TEXT PRIMARY KEY,
+			created     INTEGER NOT NULL,
+			creator     TEXT NOT NULL,
+			next_id     TEXT NOT NULL,
+			next_author TEXT NOT NULL,
+			modified    INTEGER NOT NULL,
+			complete    INTEGER NOT NULL,
+			words       INTEGER NOT NULL
+		)`,
+		`CREATE INDEX stories_by_next_author ON stories (complete, next_author, modified)`,
+		`CREATE INDEX stories_by_modified ON stories (complete, modified)`,
+		`CREATE TABLE story_authors (
+			story_id TEXT NOT NULL REFERENCES stories (id),
+			position INTEGER NOT NULL,
+			author   TEXT NOT NULL,
+			PRIMARY KEY (story_id, position)
+		)`,
+		`CREATE TABLE story_parts (
+			story_id TEXT NOT NULL REFERENCES stories (id),
+			position INTEGER NOT NULL,
+			id       TEXT NOT NULL,
+			hidden   TEXT NOT NULL,
+			visible  TEXT NOT NULL,
+			written  INTEGER NOT NULL,
+			author   TEXT NOT NULL,
+			PRIMARY KEY (story_id, position)
+		)`,
+		// Equivalent of the StoryAuthor kind: only in-progress stories.
+		`CREATE TABLE in_progress_authors (
+			author   TEXT NOT NULL,
+			story_id TEXT NOT NULL REFERENCES stories (id),
+			PRIMARY KEY (author, story_id)
+		)`,
+		`CREATE TABLE user_info (
+			email TEXT PRIMARY KEY,
+			name  TEXT NOT NULL
+		)`,
+	},
+	// 2: Turn deadlines and story history.
+	{
+		`ALTER TABLE stories ADD COLUMN reminder_hours INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN timeout_hours INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN last_reminder INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE story_events (
+			story_id  TEXT NOT NULL REFERENCES stories (id),
+			position  INTEGER NOT NULL,
+			time      INTEGER NOT NULL,
+			author    TEXT NOT NULL,
+			event     TEXT NOT NULL,
+			by_author TEXT NOT NULL,
+			PRIMARY KEY (story_id, position)
+		)`,
+	},
+	// 3: Deleting and archiving stories.
+	{
+		`ALTER TABLE stories ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN archived INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 4: Notification preferences.
+	{
+		`ALTER TABLE user_info ADD COLUMN notify TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE user_info ADD COLUMN last_digest INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 5: Email login links.
+	{
+		`CREATE TABLE login_tokens (
+			id      TEXT PRIMARY KEY,
+			email   TEXT NOT NULL,
+			expires INTEGER NOT NULL
+		)`,
+		`CREATE TABLE secrets (
+			name  TEXT PRIMARY KEY,
+			value BLOB NOT NULL
+		)`,
+	},
+	// 6: Login sessions.
+	{
+		`CREATE TABLE sessions (
+			id         TEXT PRIMARY KEY,
+			email      TEXT NOT NULL,
+			created    INTEGER NOT NULL,
+			last_seen  INTEGER NOT NULL,
+			expires    INTEGER NOT NULL,
+			user_agent TEXT NOT NULL,
+			ip_hash    TEXT NOT NULL
+		)`,
+		`CREATE INDEX sessions_by_email ON sessions (email)`,
+	},
+	// 7: Personal API tokens.
+	{
+		`CREATE TABLE api_tokens (
+			hash      TEXT PRIMARY KEY,
+			email     TEXT NOT NULL,
+			label     TEXT NOT NULL,
+			created   INTEGER NOT NULL,
+			last_used INTEGER NOT NULL
+		)`,
+		`CREATE INDEX api_tokens_by_email ON api_tokens (email)`,
+	},
+	// 8: Webhook subscriptions and their deliveries.
+	{
+		`CREATE TABLE webhooks (
+			id       TEXT PRIMARY KEY,
+			email    TEXT NOT NULL,
+			story_id TEXT NOT NULL,
+			url      TEXT NOT NULL,
+			secret   TEXT NOT NULL,
+			events   TEXT NOT NULL,
+			created  INTEGER NOT NULL
+		)`,
+		`CREATE INDEX webhooks_by_email ON webhooks (email)`,
+		`CREATE TABLE webhook_deliveries (
+			id           TEXT PRIMARY KEY,
+			webhook_id   TEXT NOT NULL,
+			event        TEXT NOT NULL,
+			payload      TEXT NOT NULL,
+			created      INTEGER NOT NULL,
+			state        TEXT NOT NULL,
+			attempts     INTEGER NOT NULL,
+			next_attempt INTEGER NOT NULL,
+			last_attempt INTEGER NOT NULL,
+			status       INTEGER NOT NULL,
+			error        TEXT NOT NULL
+		)`,
+		`CREATE INDEX webhook_deliveries_by_state ON webhook_deliveries (state, next_attempt)`,
+		`CREATE INDEX webhook_deliveries_by_webhook ON webhook_deliveries (webhook_id, created)`,
+	},
+	// 9: Chat addresses.
+	{
+		`ALTER TABLE user_info ADD COLUMN chat TEXT NOT NULL DEFAULT ''`,
+	},
+	// 10: The outbox of messages waiting to be sent.
+	{
+		`CREATE TABLE outbox (
+			id           TEXT PRIMARY KEY,
+			story_id     TEXT NOT NULL,
+			kind         TEXT NOT NULL,
+			recipients   TEXT NOT NULL,
+			reply_to     TEXT NOT NULL,
+			subject      TEXT NOT NULL,
+			body         TEXT NOT NULL,
+			created      INTEGER NOT NULL,
+			state        TEXT NOT NULL,
+			attempts     INTEGER NOT NULL,
+			next_attempt INTEGER NOT NULL,
+			last_attempt INTEGER NOT NULL,
+			error        TEXT NOT NULL
+		)`,
+		`CREATE INDEX outbox_by_state ON outbox (state, next_attempt)`,
+	},
+	// 11: How much of each part the next author sees.
+	{
+		`ALTER TABLE stories ADD COLUMN visible_mode TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE stories ADD COLUMN visible_words INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 12: Limits on the length of each part.
+	{
+		`ALTER TABLE stories ADD COLUMN length_unit TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE stories ADD COLUMN min_length INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN max_length INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN word_quota INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 13: Completion rules.
+	{
+		`ALTER TABLE stories ADD COLUMN end_rule TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE stories ADD COLUMN end_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE stories ADD COLUMN deadline INTEGER NOT NULL DEFAULT 0`,
+	},
+	// 14: Turn orders.
+	{
+		`ALTER TABLE stories ADD COLUMN turn_order TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE stories ADD COLUMN round TEXT NOT NULL DEFAULT ''`,
+	},
+	// 15: Webhook deliveries are saved with their story.
+	{
+		`ALTER TABLE webhook_deliveries ADD COLUMN story_id TEXT NOT NULL DEFAULT ''`,
+	},
+	// 16: Login tokens are looked up by address, to limit how often
+	// links are sent.
+	{
+		`CREATE INDEX login_tokens_by_email ON login_tokens (email, expires)`,
+	},
+}
+
+// StoryStore backed by a SQL database (in practice, a single SQLite file).
+type sqlStore struct {
+	db *sql.DB
+	// The signing key, read when the store is opened.
+	key []byte
+}
+
+// Opens a SQL-backed StoryStore, migrating the schema to the latest
+// version.  The caller is responsible for importing the driver.
+func OpenSQLStore(driver, dataSource string) (StoryStore, error) {
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer at a time anyway.
+	db.SetMaxOpenConns(1)
+	s, err := newSQLStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Migrates the database and reads the signing key.  A store without its
+// key would sign everything with an empty one, so failing to read it is
+// an error rather than something to retry later.
+func newSQLStore(db *sql.DB) (*sqlStore, error) {
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO secrets (name, value) VALUES ('signing', ?)`,
+		[]byte(randomString(32))); err != nil {
+		return nil, err
+	}
+	var key []byte
+	if err := db.QueryRow(`SELECT value FROM secrets WHERE name = 'signing'`).Scan(&key); err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("The signing key is empty.")
+	}
+	return &sqlStore{db: db, key: key}, nil
+}
+
+// Applies any migrations that haven't been applied yet, each in its own
+// transaction.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := db.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[version] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Common interface of *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Panics with an *appError if err is non-nil.
+func check(err error, message string) {
+	if err != nil {
+		panic(&appError{err, message, http.StatusInternalServerError})
+	}
+}
+
+// Stores a time as unix nanoseconds, with 0 for the zero time.  Used
+// both as a query argument and as a Scan destination.
+type unixTime struct {
+	t *time.Time
+}
+
+func (u unixTime) Value() (driver.Value, error) {
+	if u.t.IsZero() {
+		return int64(0), nil
+	}
+	return u.t.UnixNano(), nil
+}
+
+func (u unixTime) Scan(src interface{}) error {
+	n, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("Expected integer time, got %T", src)
+	}
+	if n == 0 {
+		*u.t = time.Time{}
+	} else {
+		*u.t = time.Unix(0, n)
+	}
+	return nil
+}
+
+// Stores a list of strings (none containing sep) as one string.
+type joinedList struct {
+	l   *[]string
+	sep string
+}
+
+// Lists of words, separated by commas.
+func commaList(l *[]string) joinedList { return joinedList{l, ","} }
+
+// Lists of anything without newlines, one per line.
+func lineList(l *[]string) joinedList { return joinedList{l, "\n"} }
+
+func (j joinedList) Value() (driver.Value, error) {
+	return strings.Join(*j.l, j.sep), nil
+}
+
+func (j joinedList) Scan(src interface{}) error {
+	var s string
+	switch src := src.(type) {
+	case string:
+		s = src
+	case []byte:
+		s = string(src)
+	default:
+		return fmt.Errorf("Expected string list, got %T", src)
+	}
+	*j.l = nil
+	if s != "" {
+		*j.l = strings.Split(s, j.sep)
+	}
+	return nil
+}
+
+// Columns of the stories table, in the same order as storyFields.
+var storyColumns = []string{
+	"id", "created", "creator", "next_id", "next_author", "modified", "complete", "words",
+	"reminder_hours", "timeout_hours", "last_reminder", "deleted", "archived",
+	"visible_mode", "visible_words", "length_unit", "min_length", "max_length", "word_quota",
+	"end_rule", "end_count", "deadline", "turn_order", "round",
+}
+
+// Returns pointers to the stored fields of the story, for use either as
+// Scan destinations or as query arguments.
+func storyFields(s *Story) []interface{} {
+	return []interface{}{
+		&s.Id, unixTime{&s.Created}, &s.Creator, &s.NextId, &s.NextAuthor, unixTime{&s.Modified},
+		&s.Complete, &s.Words, &s.ReminderHours, &s.TimeoutHours, unixTime{&s.LastReminder},
+		unixTime{&s.Deleted}, &s.Archived, &s.VisibleMode, &s.VisibleWords,
+		&s.LengthUnit, &s.MinLength, &s.MaxLength, &s.WordQuota,
+		&s.EndRule, &s.EndCount, unixTime{&s.Deadline}, &s.TurnOrder, lineList(&s.Round),
+	}
+}
+
+// Condition matching the stories that are Active.
+const activeStories = `complete = 0 AND archived = 0 AND deleted = 0`
+
+// Returns the select statement for the stories matching the rest of
+// the query, e.g. "WHERE id = ?".
+func selectStories(rest string) string {
+	return "SELECT " + strings.Join(storyColumns, ", ") + " FROM stories " + rest
+}
+
+// Runs a query made by selectStories and returns the fully loaded stories.
+func loadStories(q querier, query string, args ...interface{}) []Story {
+	rows, err := q.Query(query, args...)
+	check(err, "Failed to fetch stories")
+	stories := make([]Story, 0)
+	for rows.Next() {
+		var story Story
+		if err := rows.Scan(storyFields(&story)...); err != nil {
+			rows.Close()
+			check(err, "Failed to read story")
+		}
+		stories = append(stories, story)
+	}
+	check(rows.Err(), "Failed to fetch stories")
+	rows.Close()
+	for i := range stories {
+		loadStoryChildren(q, &stories[i])
+	}
+	return stories
+}
+
+// Runs the query for the given story ID, calling scan for each row.
+func eachRow(q querier, query string, id string, scan func(*sql.Rows) error) {
+	rows, err := q.Query(query, id)
+	check(err, "Failed to fetch story details")
+	defer rows.Close()
+	for rows.Next() {
+		check(scan(rows), "Failed to read story details")
+	}
+	check(rows.Err(), "Failed to fetch story details")
+}
+
+// Fills in Authors, Parts and History, in order.
+func loadStoryChildren(q querier, story *Story) {
+	story.Authors = make([]string, 0)
+	eachRow(q, `SELECT author FROM story_authors WHERE story_id = ? ORDER BY position`, story.Id,
+		func(rows *sql.Rows) error {
+			var author string
+			err := rows.Scan(&author)
+			story.Authors = append(story.Authors, author)
+			return err
+		})
+	story.Parts = make([]StoryPart, 0)
+	eachRow(q, `SELECT id, hidden, visible, written, author FROM story_parts
+		WHERE story_id = ? ORDER BY position`, story.Id,
+		func(rows *sql.Rows) error {
+			var part StoryPart
+			err := rows.Scan(&part.Id, &part.Hidden, &part.Visible, unixTime{&part.Written}, &part.Author)
+			story.Parts = append(story.Parts, part)
+			return err
+		})
+	story.History = nil
+	eachRow(q, `SELECT time, author, event, by_author FROM story_events
+		WHERE story_id = ? ORDER BY position`, story.Id,
+		func(rows *sql.Rows) error {
+			var event StoryEvent
+			err := rows.Scan(unixTime{&event.Time}, &event.Author, &event.Event, &event.By)
+			story.History = append(story.History, event)
+			return err
+		})
+}
+
+// Inserts a new story row.
+func insertStory(q querier, story *Story) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(storyColumns)), ", ")
+	_, err := q.Exec("INSERT INTO stories ("+strings.Join(storyColumns, ", ")+") VALUES ("+placeholders+")",
+		storyFields(story)...)
+	return err
+}
+
+// Updates an existing story row.
+func updateStory(q querier, story *Story) error {
+	sets := make([]string, len(storyColumns))
+	for i, column := range storyColumns {
+		sets[i] = column + " = ?"
+	}
+	_, err := q.Exec("UPDATE stories SET "+strings.Join(sets, ", ")+" WHERE id = ?",
+		append(storyFields(story), story.Id)...)
+	return err
+}
+
+// Replaces the stored authors, parts and history of the story.
+func saveStoryChildren(q querier, story *Story) error {
+	for _, table := range []string{"story_authors", "story_parts", "story_events"} {
+		if _, err := q.Exec(`DELETE FROM `+table+` WHERE story_id = ?`, story.Id); err != nil {
+			return err
+		}
+	}
+	for i, author := range story.Authors {
+		if _, err := q.Exec(`INSERT INTO story_authors (story_id, position, author) VALUES (?, ?, ?)`,
+			story.Id, i, author); err != nil {
+			return err
+		}
+	}
+	for i, part := range story.Parts {
+		if _, err := q.Exec(`INSERT INTO story_parts (story_id, position, id, hidden, visible, written, author)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			story.Id, i, part.Id, part.Hidden, part.Visible, unixTime{&part.Written}, part.Author); err != nil {
+			return err
+		}
+	}
+	for i, event := range story.History {
+		if _, err := q.Exec(`INSERT INTO story_events (story_id, position, time, author, event, by_author)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			story.Id, i, unixTime{&event.Time}, event.Author, event.Event, event.By); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the story's authors to in_progress_authors.
+func indexAuthors(q querier, story *Story) error {
+	for _, author := range story.Authors {
+		if _, err := q.Exec(`INSERT OR IGNORE INTO in_progress_authors (author, story_id) VALUES (?, ?)`,
+			author, story.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs f in a transaction, committing only if it returns nil.
+func (s *sqlStore) inTransaction(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			tx.Rollback()
+			panic(e)
+		}
+	}()
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) CurrentStory(author string) *Story {
+	stories := loadStories(s.db, selectStories(
+		`WHERE `+activeStories+` AND next_author = ? ORDER BY modified LIMIT 1`), author)
+	if len(stories) > 0 {
+		return &stories[0]
+	}
+	return nil
+}
+
+func (s *sqlStore) InProgressStories(author string) []Story {
+	return loadStories(s.db, selectStories(
+		`WHERE id IN (SELECT story_id FROM in_progress_authors WHERE author = ?) ORDER BY modified`), author)
+}
+
+func (s *sqlStore) FetchStory(id string) *Story {
+	stories := loadStories(s.db, selectStories(`WHERE id = ?`), id)
+	if len(stories) > 0 {
+		return &stories[0]
+	}
+	return nil
+}
+
+func (s *sqlStore) CompletedStories(limit int, olderThan time.Time) []Story {
+	return loadStories(s.db, selectStories(
+		`WHERE complete = 1 AND deleted = 0 AND modified < ? ORDER BY modified DESC LIMIT ?`),
+		unixTime{&olderThan}, limit)
+}
+
+func (s *sqlStore) CompletedStoriesBy(author string, limit int) []Story {
+	return loadStories(s.db, selectStories(
+		`WHERE complete = 1 AND deleted = 0 AND id IN (SELECT story_id FROM story_authors WHERE author = ?)
+		ORDER BY modified DESC LIMIT ?`), author, limit)
+}
+
+func (s *sqlStore) IdleStories(modifiedBefore time.Time) []Story {
+	return loadStories(s.db, selectStories(`WHERE `+activeStories+` AND modified < ?`), unixTime{&modifiedBefore})
+}
+
+func (s *sqlStore) DeletedStories(deletedBefore time.Time) []Story {
+	return loadStories(s.db, selectStories(`WHERE deleted > 0 AND deleted < ?`), unixTime{&deletedBefore})
+}
+
+// Since queue may read the store, it's called before the transaction
+// begins.
+func (s *sqlStore) PutNewStory(story *Story, minLength int, queue func(Story) Queued) {
+	id := randomString(32)
+	var e error
+	for i := minLength; i < len(id); i++ {
+		story.Id = id[:i]
+		queued := queue(*story)
+		e = s.inTransaction(func(tx *sql.Tx) error {
+			var existing string
+			err := tx.QueryRow(`SELECT id FROM stories WHERE id = ?`, story.Id).Scan(&existing)
+			if err == nil {
+				return errKeyTaken
+			} else if err != sql.ErrNoRows {
+				return err
+			}
+			if err := insertStory(tx, story); err != nil {
+				return err
+			}
+			if err := saveStoryChildren(tx, story); err != nil {
+				return err
+			}
+			if err := indexAuthors(tx, story); err != nil {
+				return err
+			}
+			return putQueued(tx, queued)
+		})
+		if e == nil {
+			return
+		}
+	}
+	story.Id = ""
+	panic(&appError{e, "Failed to put story in database", http.StatusInternalServerError})
+}
+
+func (s *sqlStore) UpdateStory(story *Story, partId string, queued Queued) {
+	e := s.inTransaction(func(tx *sql.Tx) error {
+		var nextId string
+		if err := tx.QueryRow(`SELECT next_id FROM stories WHERE id = ?`, story.Id).Scan(&nextId); err != nil {
+			return err
+		}
+		if nextId != partId {
+			return errConcurrentPart
+		}
+		if err := updateStory(tx, story); err != nil {
+			return err
+		}
+		if err := saveStoryChildren(tx, story); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM in_progress_authors WHERE story_id = ?`, story.Id); err != nil {
+			return err
+		}
+		if story.Active() {
+			if err := indexAuthors(tx, story); err != nil {
+				return err
+			}
+		}
+		return putQueued(tx, queued)
+	})
+	if e == errConcurrentPart {
+		panic(&appError{e, e.Error(), http.StatusConflict})
+	}
+	check(e, "Failed to update story")
+}
+
+func (s *sqlStore) DeleteStory(id string) {
+	e := s.inTransaction(func(tx *sql.Tx) error {
+		for _, table := range []string{"in_progress_authors", "story_events", "story_parts", "story_authors"} {
+			if _, err := tx.Exec(`DELETE FROM `+table+` WHERE story_id = ?`, id); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM stories WHERE id = ?`, id)
+		return err
+	})
+	check(e, "Failed to delete story")
+}
+
+func (s *sqlStore) Clear() {
+	for _, table := range []string{"in_progress_authors", "story_events", "story_parts", "story_authors", "stories", "user_info", "login_tokens", "sessions", "api_tokens", "webhook_deliveries", "webhooks", "outbox"} {
+		_, err := s.db.Exec(`DELETE FROM ` + table)
+		check(err, "Failed to delete all "+table)
+	}
+}
+
+func (s *sqlStore) GetName(email string) *string {
+	var name string
+	err := s.db.QueryRow(`SELECT name FROM user_info WHERE email = ?`, email).Scan(&name)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch user info")
+	if name == "" {
+		return nil
+	}
+	return &name
+}
+
+func (s *sqlStore) PutName(name, email string) {
+	// Best effort, like the datastore.
+	s.db.Exec(`INSERT INTO user_info (email, name) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET name = excluded.name`, email, name)
+}
+
+func (s *sqlStore) GetUserInfo(email string) *UserInfo {
+	info := &UserInfo{Email: email}
+	err := s.db.QueryRow(`SELECT name, notify, last_digest, chat FROM user_info WHERE email = ?`, email).
+		Scan(&info.Name, &info.Notify, unixTime{&info.LastDigest}, &info.Chat)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch user info")
+	return info
+}
+
+func (s *sqlStore) PutUserInfo(info UserInfo) {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO user_info (email, name, notify, last_digest, chat) VALUES (?, ?, ?, ?, ?)`,
+		info.Email, info.Name, info.Notify, unixTime{&info.LastDigest}, info.Chat)
+	check(err, "Failed to save user info")
+}
+
+func (s *sqlStore) DigestUsers() []UserInfo {
+	users := make([]UserInfo, 0)
+	rows, err := s.db.Query(`SELECT email, name, notify, last_digest, chat FROM user_info WHERE notify = ?`, notifyDigest)
+	check(err, "Failed to fetch digest users")
+	defer rows.Close()
+	for rows.Next() {
+		var info UserInfo
+		check(rows.Scan(&info.Email, &info.Name, &info.Notify, unixTime{&info.LastDigest}, &info.Chat),
+			"Failed to read user info")
+		users = append(users, info)
+	}
+	check(rows.Err(), "Failed to fetch digest users")
+	return users
+}
+
+func (s *sqlStore) PutLoginToken(token LoginToken) {
+	_, err := s.db.Exec(`INSERT INTO login_tokens (id, email, expires) VALUES (?, ?, ?)`,
+		token.Id, token.Email, unixTime{&token.Expires})
+	check(err, "Failed to save login token")
+}
+
+func (s *sqlStore) TakeLoginToken(id string) *LoginToken {
+	var token *LoginToken
+	e := s.inTransaction(func(tx *sql.Tx) error {
+		t := &LoginToken{Id: id}
+		err := tx.QueryRow(`SELECT email, expires FROM login_tokens WHERE id = ?`, id).
+			Scan(&t.Email, unixTime{&t.Expires})
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		token = t
+		_, err = tx.Exec(`DELETE FROM login_tokens WHERE id = ?`, id)
+		return err
+	})
+	check(e, "Failed to fetch login token")
+	return token
+}
+
+func (s *sqlStore) HasLoginToken(email string, expiresAfter time.Time) bool {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM login_tokens WHERE email = ? AND expires > ?`,
+		email, unixTime{&expiresAfter}).Scan(&n)
+	check(err, "Failed to fetch login tokens")
+	return n > 0
+}
+
+func (s *sqlStore) PurgeLoginTokens(expiredBefore time.Time) {
+	_, err := s.db.Exec(`DELETE FROM login_tokens WHERE expires < ?`, unixTime{&expiredBefore})
+	check(err, "Failed to delete expired login tokens")
+}
+
+const sessionColumns = `id, email, created, last_seen, expires, user_agent, ip_hash`
+
+func sessionFields(s *Session) []interface{} {
+	return []interface{}{&s.Id, &s.Email, unixTime{&s.Created}, unixTime{&s.LastSeen},
+		unixTime{&s.Expires}, &s.UserAgent, &s.IPHash}
+}
+
+func (s *sqlStore) PutSession(session Session) {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sessionFields(&session)...)
+	check(err, "Failed to save session")
+}
+
+func (s *sqlStore) GetSession(id string) *Session {
+	session := new(Session)
+	err := s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id).Scan(sessionFields(session)...)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch session")
+	return session
+}
+
+func (s *sqlStore) UserSessions(email string) []Session {
+	sessions := make([]Session, 0)
+	eachRow(s.db, `SELECT `+sessionColumns+` FROM sessions WHERE email = ? ORDER BY last_seen DESC`, email,
+		func(rows *sql.Rows) error {
+			var session Session
+			err := rows.Scan(sessionFields(&session)...)
+			sessions = append(sessions, session)
+			return err
+		})
+	return sessions
+}
+
+func (s *sqlStore) DeleteSession(id string) {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	check(err, "Failed to delete session")
+}
+
+func (s *sqlStore) PurgeSessions(expiredBefore time.Time) {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires < ?`, unixTime{&expiredBefore})
+	check(err, "Failed to delete expired sessions")
+}
+
+const apiTokenColumns = `hash, email, label, created, last_used`
+
+func apiTokenFields(t *APIToken) []interface{} {
+	return []interface{}{&t.Hash, &t.Email, &t.Label, unixTime{&t.Created}, unixTime{&t.LastUsed}}
+}
+
+func (s *sqlStore) PutAPIToken(token APIToken) {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO api_tokens (`+apiTokenColumns+`) VALUES (?, ?, ?, ?, ?)`,
+		apiTokenFields(&token)...)
+	check(err, "Failed to save API token")
+}
+
+func (s *sqlStore) GetAPIToken(hash string) *APIToken {
+	token := new(APIToken)
+	err := s.db.QueryRow(`SELECT `+apiTokenColumns+` FROM api_tokens WHERE hash = ?`, hash).Scan(apiTokenFields(token)...)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch API token")
+	return token
+}
+
+func (s *sqlStore) UserAPITokens(email string) []APIToken {
+	tokens := make([]APIToken, 0)
+	eachRow(s.db, `SELECT `+apiTokenColumns+` FROM api_tokens WHERE email = ? ORDER BY created`, email,
+		func(rows *sql.Rows) error {
+			var token APIToken
+			err := rows.Scan(apiTokenFields(&token)...)
+			tokens = append(tokens, token)
+			return err
+		})
+	return tokens
+}
+
+func (s *sqlStore) DeleteAPIToken(hash string) {
+	_, err := s.db.Exec(`DELETE FROM api_tokens WHERE hash = ?`, hash)
+	check(err, "Failed to delete API token")
+}
+
+const webhookColumns = `id, email, story_id, url, secret, events, created`
+
+func webhookFields(h *Webhook) []interface{} {
+	return []interface{}{&h.Id, &h.Email, &h.StoryId, &h.URL, &h.Secret, commaList(&h.Events), unixTime{&h.Created}}
+}
+
+func (s *sqlStore) PutWebhook(hook Webhook) {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO webhooks (`+webhookColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		webhookFields(&hook)...)
+	check(err, "Failed to save webhook")
+}
+
+func (s *sqlStore) GetWebhook(id string) *Webhook {
+	hook := new(Webhook)
+	err := s.db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id).Scan(webhookFields(hook)...)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch webhook")
+	return hook
+}
+
+func (s *sqlStore) UserWebhooks(email string) []Webhook {
+	hooks := make([]Webhook, 0)
+	eachRow(s.db, `SELECT `+webhookColumns+` FROM webhooks WHERE email = ? ORDER BY created`, email,
+		func(rows *sql.Rows) error {
+			var hook Webhook
+			err := rows.Scan(webhookFields(&hook)...)
+			hooks = append(hooks, hook)
+			return err
+		})
+	return hooks
+}
+
+func (s *sqlStore) DeleteWebhook(id string) {
+	e := s.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+		return err
+	})
+	check(e, "Failed to delete webhook")
+}
+
+const deliveryColumns = `id, webhook_id, story_id, event, payload, created, state, attempts, next_attempt, last_attempt, status, error`
+
+func deliveryFields(d *WebhookDelivery) []interface{} {
+	return []interface{}{&d.Id, &d.WebhookId, &d.StoryId, &d.Event, &d.Payload, unixTime{&d.Created}, &d.State,
+		&d.Attempts, unixTime{&d.NextAttempt}, unixTime{&d.LastAttempt}, &d.Status, &d.Error}
+}
+
+func putDelivery(q querier, d WebhookDelivery) error {
+	_, err := q.Exec(`INSERT OR REPLACE INTO webhook_deliveries (`+deliveryColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, deliveryFields(&d)...)
+	return err
+}
+
+func (s *sqlStore) PutDelivery(d WebhookDelivery) {
+	check(putDelivery(s.db, d), "Failed to save webhook delivery")
+}
+
+// Runs a query for webhook deliveries.
+func (s *sqlStore) queryDeliveries(query string, args ...interface{}) []WebhookDelivery {
+	rows, err := s.db.Query(`SELECT `+deliveryColumns+` FROM webhook_deliveries `+query, args...)
+	check(err, "Failed to fetch webhook deliveries")
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		check(rows.Scan(deliveryFields(&d)...), "Failed to read webhook delivery")
+		deliveries = append(deliveries, d)
+	}
+	check(rows.Err(), "Failed to fetch webhook deliveries")
+	return deliveries
+}
+
+func (s *sqlStore) DueDeliveries(due time.Time, limit int) []WebhookDelivery {
+	return s.queryDeliveries(`WHERE state = ? AND next_attempt <= ? ORDER BY next_attempt LIMIT ?`,
+		deliveryPending, unixTime{&due}, limit)
+}
+
+func (s *sqlStore) WebhookDeliveries(webhookId string, limit int) []WebhookDelivery {
+	return s.queryDeliveries(`WHERE webhook_id = ? ORDER BY created DESC LIMIT ?`, webhookId, limit)
+}
+
+func (s *sqlStore) PurgeDeliveries(createdBefore time.Time) {
+	_, err := s.db.Exec(`DELETE FROM webhook_deliveries WHERE state != ? AND created < ?`,
+		deliveryPending, unixTime{&createdBefore})
+	check(err, "Failed to delete old webhook deliveries")
+}
+
+const outboxColumns = `id, story_id, kind, recipients, reply_to, subject, body, created, state, attempts,
+	next_attempt, last_attempt, error`
+
+// Addresses can contain commas, so the recipients are separated by newlines.
+func outboxFields(m *OutboxMessage) []interface{} {
+	return []interface{}{&m.Id, &m.StoryId, &m.Kind, lineList(&m.To), &m.ReplyTo, &m.Subject, &m.Body,
+		unixTime{&m.Created}, &m.State, &m.Attempts, unixTime{&m.NextAttempt}, unixTime{&m.LastAttempt}, &m.Error}
+}
+
+func putOutboxMessage(q querier, m OutboxMessage) error {
+	_, err := q.Exec(`INSERT OR REPLACE INTO outbox (`+outboxColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, outboxFields(&m)...)
+	return err
+}
+
+// Saves the messages and deliveries queued by a story update.
+func putQueued(q querier, queued Queued) error {
+	for _, m := range queued.Outbox {
+		if err := putOutboxMessage(q, m); err != nil {
+			return err
+		}
+	}
+	for _, d := range queued.Deliveries {
+		if err := putDelivery(q, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) PutOutboxMessage(m OutboxMessage) {
+	check(putOutboxMessage(s.db, m), "Failed to queue message")
+}
+
+func (s *sqlStore) GetOutboxMessage(id string) *OutboxMessage {
+	m := new(OutboxMessage)
+	err := s.db.QueryRow(`SELECT `+outboxColumns+` FROM outbox WHERE id = ?`, id).Scan(outboxFields(m)...)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	check(err, "Failed to fetch queued message")
+	return m
+}
+
+func (s *sqlStore) DeleteOutboxMessage(id string) {
+	_, err := s.db.Exec(`DELETE FROM outbox WHERE id = ?`, id)
+	check(err, "Failed to delete queued message")
+}
+
+// Runs a query for outbox messages.
+func (s *sqlStore) queryOutbox(query string, args ...interface{}) []OutboxMessage {
+	rows, err := s.db.Query(`SELECT `+outboxColumns+` FROM outbox `+query, args...)
+	check(err, "Failed to fetch queued messages")
+	defer rows.Close()
+	msgs := make([]OutboxMessage, 0)
+	for rows.Next() {
+		var m OutboxMessage
+		check(rows.Scan(outboxFields(&m)...), "Failed to read queued message")
+		msgs = append(msgs, m)
+	}
+	check(rows.Err(), "Failed to fetch queued messages")
+	return msgs
+}
+
+func (s *sqlStore) DueOutboxMessages(due time.Time, limit int) []OutboxMessage {
+	return s.queryOutbox(`WHERE state = ? AND next_attempt <= ? ORDER BY next_attempt LIMIT ?`,
+		outboxPending, unixTime{&due}, limit)
+}
+
+func (s *sqlStore) DeadOutboxMessages(limit int) []OutboxMessage {
+	return s.queryOutbox(`WHERE state = ? ORDER BY last_attempt DESC LIMIT ?`, outboxDead, limit)
+}
+
+func (s *sqlStore) PurgeOutbox(createdBefore time.Time) {
+	_, err := s.db.Exec(`DELETE FROM outbox WHERE state = ? AND created < ?`, outboxSent, unixTime{&createdBefore})
+	check(err, "Failed to delete sent messages")
+}
+
+// The key never changes, so it's read when the store is opened.
+func (s *sqlStore) SigningKey() []byte {
+	return s.key
+}
+
+// Nothing is cached outside the database.
+func (s *sqlStore) FlushUserCache() {}
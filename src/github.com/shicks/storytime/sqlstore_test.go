@@ -0,0 +1,421 @@
+//go:build !appengine
+// +build !appengine
+
+package storytime
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A store under test.
+type testStore struct {
+	name string
+	st   StoryStore
+}
+
+// Returns an empty store of each kind, so that the same tests can check
+// that they behave alike.
+func testStores(t *testing.T) []testStore {
+	sqlite, err := OpenSQLStore("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("OpenSQLStore failed: %v", err)
+	}
+	return []testStore{{"memory", newMemoryStore()}, {"sql", sqlite}}
+}
+
+// Returns a time that survives the SQL store's round trip unchanged.
+func testTime(minutes int) time.Time {
+	return time.Unix(0, time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC).Add(time.Duration(minutes)*time.Minute).UnixNano())
+}
+
+// Returns the error that f panics with, or nil.
+func panicked(f func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if ae, ok := e.(*appError); ok {
+				err = ae.Error
+			} else {
+				err = fmt.Errorf("%v", e)
+			}
+		}
+	}()
+	f()
+	return nil
+}
+
+// Returns the IDs of the stories.
+func storyIds(stories []Story) []string {
+	ids := make([]string, len(stories))
+	for i, s := range stories {
+		ids[i] = s.Id
+	}
+	return ids
+}
+
+// Saves a new story with the given fields filled in, returning its ID.
+// Like the handlers, it saves the story while it's active, and then
+// updates it if it's finished, archived or deleted.
+func putTestStory(st StoryStore, story Story) string {
+	active := story
+	active.Complete, active.Archived, active.Deleted = false, false, time.Time{}
+	st.PutNewStory(&active, 8, func(Story) Queued { return Queued{} })
+	if !story.Active() {
+		story.Id = active.Id
+		st.UpdateStory(&story, story.NextId, Queued{})
+	}
+	return active.Id
+}
+
+func TestStoreRoundTrip(t *testing.T) {
+	story := Story{
+		Created: testTime(0), Creator: "a@x.com", NextId: "p3", NextAuthor: "b@x.com", Modified: testTime(5),
+		Parts: []StoryPart{
+			{Id: "p1", Hidden: "Once", Visible: "upon a time", Written: testTime(1), Author: "a@x.com"},
+			{Id: "p2", Hidden: "", Visible: "there was a cat.", Written: testTime(2), Author: "b@x.com"},
+		},
+		Authors: []string{"a@x.com", "b@x.com", "c@x.com"}, TurnOrder: orderShuffled, Round: []string{"c@x.com"},
+		Words: 500, EndRule: endAtDeadline, EndCount: 3, Deadline: testTime(60),
+		VisibleMode: visibleSentenceMode, VisibleWords: 7, LengthUnit: wordsUnit, MinLength: 2, MaxLength: 50,
+		WordQuota: 100, ReminderHours: 24, TimeoutHours: 48, LastReminder: testTime(3),
+		History: []StoryEvent{{Time: testTime(4), Author: "c@x.com", Event: eventSkipped, By: "a@x.com"}},
+	}
+	for _, ts := range testStores(t) {
+		s := story
+		var queuedId string
+		ts.st.PutNewStory(&s, 8, func(s Story) Queued {
+			queuedId = s.Id
+			return Queued{Outbox: []OutboxMessage{{Id: "m-" + s.Id, StoryId: s.Id, Kind: outboxMail,
+				To: []string{"b@x.com"}, State: outboxPending, NextAttempt: testTime(0)}}}
+		})
+		if len(s.Id) < 8 || queuedId != s.Id {
+			t.Errorf("%s: story ID is %q, and queue saw %q", ts.name, s.Id, queuedId)
+		}
+		if m := ts.st.GetOutboxMessage("m-" + s.Id); m == nil || m.StoryId != s.Id {
+			t.Errorf("%s: queued message = %+v", ts.name, m)
+		}
+		got := ts.st.FetchStory(s.Id)
+		if got == nil {
+			t.Errorf("%s: FetchStory returned nil", ts.name)
+		} else if fmt.Sprintf("%+v", *got) != fmt.Sprintf("%+v", s) {
+			t.Errorf("%s: FetchStory = %+v\nwant %+v", ts.name, *got, s)
+		}
+		if ts.st.FetchStory("missing") != nil {
+			t.Errorf("%s: FetchStory found a missing story", ts.name)
+		}
+	}
+}
+
+func TestStoreListings(t *testing.T) {
+	for _, ts := range testStores(t) {
+		st := ts.st
+		authors := []string{"a@x.com", "b@x.com"}
+		newer := putTestStory(st, Story{NextAuthor: "a@x.com", Authors: authors, Modified: testTime(2)})
+		older := putTestStory(st, Story{NextAuthor: "a@x.com", Authors: authors, Modified: testTime(1)})
+		waiting := putTestStory(st, Story{NextAuthor: "b@x.com", Authors: authors, Modified: testTime(3)})
+		done := putTestStory(st, Story{Complete: true, Authors: authors, Modified: testTime(4)})
+		doneEarlier := putTestStory(st, Story{Complete: true, Authors: []string{"b@x.com"}, Modified: testTime(0)})
+		archived := putTestStory(st, Story{NextAuthor: "a@x.com", Authors: authors, Modified: testTime(0), Archived: true})
+		deleted := putTestStory(st, Story{NextAuthor: "a@x.com", Authors: authors, Modified: testTime(0),
+			Deleted: testTime(5)})
+
+		tests := []struct {
+			name string
+			got  []string
+			want []string
+		}{
+			{"InProgressStories", storyIds(st.InProgressStories("a@x.com")), []string{older, newer, waiting}},
+			{"InProgressStories of nobody", storyIds(st.InProgressStories("c@x.com")), []string{}},
+			{"CompletedStories", storyIds(st.CompletedStories(10, testTime(10))), []string{done, doneEarlier}},
+			{"CompletedStories before", storyIds(st.CompletedStories(10, testTime(4))), []string{doneEarlier}},
+			{"CompletedStories limit", storyIds(st.CompletedStories(1, testTime(10))), []string{done}},
+			{"CompletedStoriesBy", storyIds(st.CompletedStoriesBy("a@x.com", 10)), []string{done}},
+			{"IdleStories", storyIds(st.IdleStories(testTime(2))), []string{older}},
+			{"DeletedStories", storyIds(st.DeletedStories(testTime(6))), []string{deleted}},
+			{"DeletedStories before", storyIds(st.DeletedStories(testTime(5))), []string{}},
+		}
+		for _, test := range tests {
+			if !reflect.DeepEqual(test.got, test.want) {
+				t.Errorf("%s: %s = %v, want %v", ts.name, test.name, test.got, test.want)
+			}
+		}
+		if current := st.CurrentStory("a@x.com"); current == nil || current.Id != older {
+			t.Errorf("%s: CurrentStory = %v, want %s", ts.name, current, older)
+		}
+		if current := st.CurrentStory("c@x.com"); current != nil {
+			t.Errorf("%s: CurrentStory of nobody = %s", ts.name, current.Id)
+		}
+
+		st.DeleteStory(archived)
+		if st.FetchStory(archived) != nil {
+			t.Errorf("%s: DeleteStory didn't delete the story", ts.name)
+		}
+	}
+}
+
+func TestStoreUpdateStory(t *testing.T) {
+	for _, ts := range testStores(t) {
+		st := ts.st
+		id := putTestStory(st, Story{NextId: "p1", NextAuthor: "a@x.com", Authors: []string{"a@x.com", "b@x.com"},
+			Modified: testTime(0)})
+		story := st.FetchStory(id)
+		story.Parts = append(story.Parts, StoryPart{Id: "p1", Visible: "Once", Written: testTime(1), Author: "a@x.com"})
+		story.NextId = "p2"
+		story.NextAuthor = "b@x.com"
+		queued := Queued{
+			Outbox:     []OutboxMessage{{Id: "m1", StoryId: id, Kind: outboxMail, State: outboxPending}},
+			Deliveries: []WebhookDelivery{{Id: "d1", WebhookId: "h1", StoryId: id, State: deliveryPending}},
+		}
+		if err := panicked(func() { st.UpdateStory(story, "p1", queued) }); err != nil {
+			t.Fatalf("%s: UpdateStory failed: %v", ts.name, err)
+		}
+		if st.GetOutboxMessage("m1") == nil || len(st.WebhookDeliveries("h1", 10)) != 1 {
+			t.Errorf("%s: UpdateStory didn't queue the message and delivery", ts.name)
+		}
+		if current := st.CurrentStory("b@x.com"); current == nil || current.Id != id {
+			t.Errorf("%s: story isn't waiting on its next author", ts.name)
+		}
+
+		// Someone else writing the same part fails, and queues nothing.
+		stale := Queued{Outbox: []OutboxMessage{{Id: "m2", StoryId: id, Kind: outboxMail, State: outboxPending}}}
+		if err := panicked(func() { st.UpdateStory(story, "p1", stale) }); err != errConcurrentPart {
+			t.Errorf("%s: concurrent UpdateStory error = %v, want %v", ts.name, err, errConcurrentPart)
+		}
+		if st.GetOutboxMessage("m2") != nil {
+			t.Errorf("%s: failed UpdateStory queued a message", ts.name)
+		}
+
+		// Completing the story takes it out of the author index.
+		story.Complete = true
+		st.UpdateStory(story, "p2", Queued{})
+		if n := len(st.InProgressStories("a@x.com")); n != 0 {
+			t.Errorf("%s: %d stories in progress after completion", ts.name, n)
+		}
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	for _, ts := range testStores(t) {
+		st := ts.st
+		if st.GetName("a@x.com") != nil || st.GetUserInfo("a@x.com") != nil {
+			t.Errorf("%s: found info for an unknown user", ts.name)
+		}
+		st.PutName("Al", "a@x.com")
+		if name := st.GetName("a@x.com"); name == nil || *name != "Al" {
+			t.Errorf("%s: GetName = %v, want Al", ts.name, name)
+		}
+		info := UserInfo{Email: "b@x.com", Name: "Bo", Notify: notifyDigest, LastDigest: testTime(1), Chat: "!room"}
+		st.PutUserInfo(info)
+		if got := st.GetUserInfo("b@x.com"); got == nil || *got != info {
+			t.Errorf("%s: GetUserInfo = %+v, want %+v", ts.name, got, info)
+		}
+		st.PutName("Bob", "b@x.com")
+		info.Name = "Bob"
+		if got := st.GetUserInfo("b@x.com"); got == nil || *got != info {
+			t.Errorf("%s: PutName didn't keep the other settings: %+v", ts.name, got)
+		}
+		if got := st.DigestUsers(); !reflect.DeepEqual(got, []UserInfo{info}) {
+			t.Errorf("%s: DigestUsers = %+v", ts.name, got)
+		}
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	for _, ts := range testStores(t) {
+		st := ts.st
+		st.PutLoginToken(LoginToken{Id: "t1", Email: "a@x.com", Expires: testTime(60)})
+		st.PutLoginToken(LoginToken{Id: "t2", Email: "a@x.com", Expires: testTime(0)})
+		if token := st.TakeLoginToken("t1"); token == nil || token.Email != "a@x.com" || !token.Expires.Equal(testTime(60)) {
+			t.Errorf("%s: TakeLoginToken = %+v", ts.name, token)
+		}
+		if st.TakeLoginToken("t1") != nil {
+			t.Errorf("%s: login token was taken twice", ts.name)
+		}
+		if !st.HasLoginToken("a@x.com", testTime(-1)) || st.HasLoginToken("a@x.com", testTime(0)) ||
+			st.HasLoginToken("b@x.com", testTime(-1)) {
+			t.Errorf("%s: HasLoginToken doesn't match the tokens left", ts.name)
+		}
+		st.PurgeLoginTokens(testTime(1))
+		if st.TakeLoginToken("t2") != nil {
+			t.Errorf("%s: expired login token wasn't purged", ts.name)
+		}
+
+		older := Session{Id: "s1", Email: "a@x.com", Created: testTime(0), LastSeen: testTime(1), Expires: testTime(10),
+			UserAgent: "Firefox", IPHash: "abc"}
+		newer := Session{Id: "s2", Email: "a@x.com", Created: testTime(0), LastSeen: testTime(2), Expires: testTime(20)}
+		st.PutSession(older)
+		st.PutSession(newer)
+		st.PutSession(Session{Id: "s3", Email: "b@x.com", LastSeen: testTime(3), Expires: testTime(20)})
+		if got := st.GetSession("s1"); got == nil || *got != older {
+			t.Errorf("%s: GetSession = %+v, want %+v", ts.name, got, older)
+		}
+		if got := st.UserSessions("a@x.com"); !reflect.DeepEqual(got, []Session{newer, older}) {
+			t.Errorf("%s: UserSessions = %+v", ts.name, got)
+		}
+		st.PurgeSessions(testTime(15))
+		st.DeleteSession("s2")
+		if st.GetSession("s1") != nil || st.GetSession("s2") != nil || st.GetSession("s3") == nil {
+			t.Errorf("%s: wrong sessions left after purging and deleting", ts.name)
+		}
+	}
+}
+
+func TestStoreQueues(t *testing.T) {
+	for _, ts := range testStores(t) {
+		st := ts.st
+		st.PutWebhook(Webhook{Id: "h1", Email: "a@x.com", URL: "https://8.8.8.8/", Secret: "s",
+			Events: []string{eventPartWritten}, Created: testTime(0)})
+		for i, state := range []string{deliveryPending, deliveryPending, deliveryDelivered} {
+			st.PutDelivery(WebhookDelivery{Id: fmt.Sprintf("d%d", i), WebhookId: "h1", State: state,
+				Created: testTime(i), NextAttempt: testTime(10 - i)})
+		}
+		if got := deliveryIds(st.DueDeliveries(testTime(10), 10)); !reflect.DeepEqual(got, []string{"d1", "d0"}) {
+			t.Errorf("%s: DueDeliveries = %v", ts.name, got)
+		}
+		if got := deliveryIds(st.DueDeliveries(testTime(9), 10)); !reflect.DeepEqual(got, []string{"d1"}) {
+			t.Errorf("%s: DueDeliveries before = %v", ts.name, got)
+		}
+		if got := deliveryIds(st.WebhookDeliveries("h1", 2)); !reflect.DeepEqual(got, []string{"d2", "d1"}) {
+			t.Errorf("%s: WebhookDeliveries = %v", ts.name, got)
+		}
+		st.PurgeDeliveries(testTime(5))
+		if got := deliveryIds(st.WebhookDeliveries("h1", 10)); !reflect.DeepEqual(got, []string{"d1", "d0"}) {
+			t.Errorf("%s: WebhookDeliveries after purging = %v", ts.name, got)
+		}
+		st.DeleteWebhook("h1")
+		if st.GetWebhook("h1") != nil || len(st.WebhookDeliveries("h1", 10)) != 0 {
+			t.Errorf("%s: DeleteWebhook left the subscription or its deliveries", ts.name)
+		}
+
+		for i, state := range []string{outboxPending, outboxPending, outboxSent, outboxDead} {
+			st.PutOutboxMessage(OutboxMessage{Id: fmt.Sprintf("m%d", i), Kind: outboxMail, To: []string{"a@x.com"},
+				State: state, Created: testTime(i), NextAttempt: testTime(10 - i), LastAttempt: testTime(i)})
+		}
+		if got := outboxIds(st.DueOutboxMessages(testTime(10), 10)); !reflect.DeepEqual(got, []string{"m1", "m0"}) {
+			t.Errorf("%s: DueOutboxMessages = %v", ts.name, got)
+		}
+		if got := outboxIds(st.DeadOutboxMessages(10)); !reflect.DeepEqual(got, []string{"m3"}) {
+			t.Errorf("%s: DeadOutboxMessages = %v", ts.name, got)
+		}
+		st.PurgeOutbox(testTime(5))
+		if st.GetOutboxMessage("m2") != nil || st.GetOutboxMessage("m0") == nil || st.GetOutboxMessage("m3") == nil {
+			t.Errorf("%s: PurgeOutbox removed the wrong messages", ts.name)
+		}
+	}
+}
+
+// Returns the IDs of the deliveries.
+func deliveryIds(deliveries []WebhookDelivery) []string {
+	ids := make([]string, len(deliveries))
+	for i, d := range deliveries {
+		ids[i] = d.Id
+	}
+	return ids
+}
+
+// Returns the IDs of the outbox messages.
+func outboxIds(msgs []OutboxMessage) []string {
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.Id
+	}
+	return ids
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Make a database with only the initial schema, and a story in it.
+	all := migrations
+	migrations = all[:1]
+	err = migrate(db)
+	migrations = all
+	if err != nil {
+		t.Fatalf("initial migration failed: %v", err)
+	}
+	for _, stmt := range []string{
+		`INSERT INTO stories (id, created, creator, next_id, next_author, modified, complete, words)
+			VALUES ('old', 1, 'a@x.com', 'p2', 'b@x.com', 2, 0, 100)`,
+		`INSERT INTO story_authors (story_id, position, author) VALUES ('old', 0, 'a@x.com'), ('old', 1, 'b@x.com')`,
+		`INSERT INTO story_parts (story_id, position, id, hidden, visible, written, author)
+			VALUES ('old', 0, 'p1', 'Once', 'upon a time', 2, 'a@x.com')`,
+		`INSERT INTO in_progress_authors (author, story_id) VALUES ('a@x.com', 'old'), ('b@x.com', 'old')`,
+		`INSERT INTO user_info (email, name) VALUES ('a@x.com', 'Al')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s failed: %v", stmt, err)
+		}
+	}
+
+	// Opening the store migrates it again, which must do nothing.
+	if err := migrate(db); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+	st, err := newSQLStore(db)
+	if err != nil {
+		t.Fatalf("newSQLStore failed: %v", err)
+	}
+	var version int
+	if err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version); err != nil || version != len(migrations) {
+		t.Errorf("schema version = %d (%v), want %d", version, err, len(migrations))
+	}
+
+	want := Story{Id: "old", Created: time.Unix(0, 1), Creator: "a@x.com", NextId: "p2", NextAuthor: "b@x.com",
+		Modified: time.Unix(0, 2), Words: 100, Authors: []string{"a@x.com", "b@x.com"},
+		Parts: []StoryPart{{Id: "p1", Hidden: "Once", Visible: "upon a time", Written: time.Unix(0, 2), Author: "a@x.com"}}}
+	if got := st.FetchStory("old"); got == nil || fmt.Sprintf("%+v", *got) != fmt.Sprintf("%+v", want) {
+		t.Errorf("migrated story = %+v\nwant %+v", got, want)
+	}
+	if current := st.CurrentStory("b@x.com"); current == nil || current.Id != "old" {
+		t.Errorf("migrated story isn't current for its next author")
+	}
+	if info := st.GetUserInfo("a@x.com"); info == nil || *info != (UserInfo{Email: "a@x.com", Name: "Al"}) {
+		t.Errorf("migrated user info = %+v", info)
+	}
+	st.PutDelivery(WebhookDelivery{Id: "d1", WebhookId: "h1", StoryId: "old", State: deliveryPending})
+	if got := st.WebhookDeliveries("h1", 1); len(got) != 1 || got[0].StoryId != "old" {
+		t.Errorf("delivery after migration = %+v", got)
+	}
+}
+
+func TestSQLSigningKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "storytime.db")
+	var keys [][]byte
+	for i := 0; i < 2; i++ {
+		st, err := OpenSQLStore("sqlite3", file)
+		if err != nil {
+			t.Fatalf("OpenSQLStore failed: %v", err)
+		}
+		keys = append(keys, st.SigningKey())
+		st.(*sqlStore).db.Close()
+	}
+	if len(keys[0]) == 0 || !bytes.Equal(keys[0], keys[1]) {
+		t.Errorf("signing keys = %q, %q, want the same non-empty key", keys[0], keys[1])
+	}
+
+	// Without the secrets table, opening fails instead of leaving the
+	// store without a key.
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`DROP TABLE secrets`); err != nil {
+		t.Fatalf("DROP TABLE failed: %v", err)
+	}
+	if st, err := newSQLStore(db); err == nil {
+		t.Errorf("newSQLStore succeeded without a key: %q", st.SigningKey())
+	}
+}
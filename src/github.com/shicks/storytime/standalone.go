@@ -0,0 +1,190 @@
+//go:build !appengine
+// +build !appengine
+
+package storytime
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// Platform for running outside of App Engine: one shared store, and
+// messages written to stdout unless cfg says otherwise.  There are no
+// platform accounts, so users sign in with emailed links (sessions.go).
+// For development, a fake login page (much like dev_appserver's) can
+// start a session for any address without sending mail.
+type localPlatform struct {
+	st       StoryStore
+	admins   map[string]bool
+	devLogin bool
+}
+
+// Returns a handler serving the whole game outside of App Engine,
+// backed by the given store.  The given emails may use the admin handlers.
+// If cfg has no Notifier, messages are written to stdout.  If devLogin
+// is set, /login signs anyone in as whatever address they enter, so it
+// must never be set on a server others can reach.
+func NewStandaloneHandler(cfg Config, store StoryStore, admins []string, devLogin bool) http.Handler {
+	if cfg.Notifier == nil {
+		cfg.Notifier = NewFileNotifier(os.Stdout)
+	}
+	p := &localPlatform{store, make(map[string]bool), devLogin}
+	for _, admin := range admins {
+		p.admins[admin] = true
+	}
+	mux := http.NewServeMux()
+	register(mux, cfg, p)
+	mux.Handle("/static/", http.StripPrefix("/static/", staticHandler(cfg.ResourceDir)))
+	if devLogin {
+		mux.Handle("/login", appHandler(login))
+	}
+	return mux
+}
+
+// Returns a new, empty, in-memory StoryStore.
+func NewMemoryStore() StoryStore {
+	return newMemoryStore()
+}
+
+// Serves the css and js files from dir, as app.yaml does on App Engine.
+func staticHandler(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Ext(r.URL.Path) {
+		case ".css", ".js":
+			files.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (p *localPlatform) store(r *http.Request) StoryStore {
+	return p.st
+}
+
+// Everyone signs in with a session, since there are no platform accounts.
+func (p *localPlatform) user(r *http.Request) *User {
+	return nil
+}
+
+func (p *localPlatform) admin(email string) bool {
+	return p.admins[email]
+}
+
+// The fake login page, if it's enabled.
+func (p *localPlatform) loginURL(r *http.Request, dest string) string {
+	if !p.devLogin {
+		return ""
+	}
+	return "/login?continue=" + url.QueryEscape(dest)
+}
+
+func (p *localPlatform) logoutURL(r *http.Request) string {
+	return "/"
+}
+
+// Outgoing requests share one client, which gives up on slow servers.
+var outgoingClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhooks get their own client, which only connects to public addresses
+// (see webhooks.go).  There's no proxy, since it would do the connecting.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}).DialContext,
+	},
+}
+
+func (p *localPlatform) httpClient(r *http.Request) *http.Client {
+	return outgoingClient
+}
+
+func (p *localPlatform) webhookClient(r *http.Request) *http.Client {
+	return webhookClient
+}
+
+// Control function for a net.Dialer that refuses to connect to anything
+// but public addresses.  By the time it runs, the host has been resolved.
+func dialPublicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// RunScheduledTasks calls the tasks directly rather than over HTTP.
+func (p *localPlatform) isTask(r *http.Request) bool {
+	return false
+}
+
+// The mail gateway proves itself with the shared secret from the config.
+func (p *localPlatform) isMail(r *http.Request) bool {
+	secret := r.Header.Get("X-Storytime-Mail-Secret")
+	return config.MailSecret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(config.MailSecret)) == 1
+}
+
+// Runs each of the background tasks every interval, forever.
+func RunScheduledTasks(interval time.Duration) {
+	for range time.Tick(interval) {
+		for path, task := range scheduledTasks {
+			runTask(path, task)
+		}
+	}
+}
+
+// Sends queued messages and webhook deliveries every interval, forever.
+func RunDeliveryTasks(interval time.Duration) {
+	for range time.Tick(interval) {
+		for path, task := range deliveryTasks {
+			runTask(path, task)
+		}
+	}
+}
+
+func runTask(path string, task appHandler) {
+	req, err := http.NewRequest("POST", config.BaseURL+path, nil)
+	if err != nil {
+		panic(err)
+	}
+	uncheckedHandler(task).ServeHTTP(discardResponse{http.Header{}}, req)
+}
+
+// ResponseWriter that throws away the response to a task.
+type discardResponse struct {
+	header http.Header
+}
+
+func (w discardResponse) Header() http.Header         { return w.header }
+func (w discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponse) WriteHeader(code int)        {}
+
+func (p *localPlatform) errorf(r *http.Request, format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// Starts a session for whatever email address is entered, without
+// sending a link.  Only mounted when devLogin is set.
+func login(r request) response {
+	if r.req.Method != "POST" {
+		return execute(&loginPage{continueParam(r)})
+	}
+	addr, err := mail.ParseAddress(r.req.FormValue("email"))
+	if err != nil {
+		panic(&appError{err, "Could not parse email address", http.StatusBadRequest})
+	}
+	return cookieRedirect{newSession(r, addr.Address), redirect(continueParam(r))}
+}
@@ -0,0 +1,374 @@
+package storytime
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Messages and webhook deliveries about a change to a story, which are
+// saved along with it so that they're sent if and only if it's saved.
+type Queued struct {
+	Outbox     []OutboxMessage
+	Deliveries []WebhookDelivery
+}
+
+// StoryStore abstracts the persistence of stories and user info, so
+// that the handlers don't depend on any particular backend.
+// Implementations report failures by panicking with an *appError, the
+// same way the handlers do.  Deleted and archived stories are left out
+// of all the listings; only FetchStory and DeletedStories return them.
+type StoryStore interface {
+	// Retrieves the current story for the given author, i.e. the least
+	// recently modified in-progress story waiting on them, or nil.
+	CurrentStory(author string) *Story
+	// Retrieves all the in-progress stories for the given author,
+	// ordered by modification time.
+	InProgressStories(author string) []Story
+	// Retrieves a story by ID.  Returns nil if there is no such story.
+	FetchStory(id string) *Story
+	// Retrieves up to limit completed stories modified before olderThan,
+	// most recent first.
+	CompletedStories(limit int, olderThan time.Time) []Story
+	// Retrieves up to limit of the given author's completed stories, most
+	// recent first.
+	CompletedStoriesBy(author string, limit int) []Story
+	// Retrieves all in-progress stories last modified before the given time.
+	IdleStories(modifiedBefore time.Time) []Story
+	// Retrieves the stories deleted before the given time.
+	DeletedStories(deletedBefore time.Time) []Story
+	// Saves a new story under a fresh random ID of at least minLength
+	// characters (filling in story.Id), and indexes it by author.  Once
+	// the ID is chosen, queue is called with the story, and whatever it
+	// returns is queued in the same transaction.
+	PutNewStory(story *Story, minLength int, queue func(Story) Queued)
+	// Saves an updated story, as long as nobody else has written the
+	// part with the given ID in the meantime, and queues the given
+	// messages and deliveries in the same transaction.  The author index
+	// is kept in sync with story.Authors, and removed once the story is no
+	// longer active.
+	UpdateStory(story *Story, partId string, queued Queued)
+	// Permanently deletes a story.
+	DeleteStory(id string)
+	// Deletes all stories, users, login tokens, sessions, API tokens,
+	// webhooks and queued messages.
+	Clear()
+
+	// Retrieves the name stored for the given email, or nil.
+	GetName(email string) *string
+	// Stores a name for the given email, keeping any other settings.
+	PutName(name, email string)
+	// Retrieves everything stored about the given email, or nil.
+	GetUserInfo(email string) *UserInfo
+	// Stores a user's info, replacing any cached name.
+	PutUserInfo(info UserInfo)
+	// Retrieves the users who want a daily digest instead of emails.
+	DigestUsers() []UserInfo
+
+	// Stores a login token that hasn't been used yet.
+	PutLoginToken(token LoginToken)
+	// Removes and returns the login token with the given ID, or nil if
+	// there is none, so that each token can only be used once.
+	TakeLoginToken(id string) *LoginToken
+	// Returns whether there's a login token for the given email that
+	// expires after the given time.
+	HasLoginToken(email string, expiresAfter time.Time) bool
+	// Deletes the login tokens that expired before the given time.
+	PurgeLoginTokens(expiredBefore time.Time)
+	// Stores a new or updated login session.
+	PutSession(session Session)
+	// Retrieves the session with the given ID, or nil.
+	GetSession(id string) *Session
+	// Retrieves all of the user's sessions, most recently used first.
+	UserSessions(email string) []Session
+	// Deletes a session, logging it out.
+	DeleteSession(id string)
+	// Deletes the sessions that expired before the given time.
+	PurgeSessions(expiredBefore time.Time)
+	// Stores a new or updated personal API token.
+	PutAPIToken(token APIToken)
+	// Retrieves the API token with the given hash, or nil.
+	GetAPIToken(hash string) *APIToken
+	// Retrieves all of the user's API tokens, oldest first.
+	UserAPITokens(email string) []APIToken
+	// Deletes an API token.
+	DeleteAPIToken(hash string)
+	// Stores a new or updated webhook subscription.
+	PutWebhook(hook Webhook)
+	// Retrieves the webhook subscription with the given ID, or nil.
+	GetWebhook(id string) *Webhook
+	// Retrieves all of the user's webhook subscriptions, oldest first.
+	UserWebhooks(email string) []Webhook
+	// Deletes a webhook subscription and its deliveries.
+	DeleteWebhook(id string)
+	// Stores a new or updated webhook delivery.
+	PutDelivery(d WebhookDelivery)
+	// Retrieves up to limit pending deliveries whose next attempt is due
+	// by the given time, most overdue first.
+	DueDeliveries(due time.Time, limit int) []WebhookDelivery
+	// Retrieves up to limit of a subscription's deliveries, newest first.
+	WebhookDeliveries(webhookId string, limit int) []WebhookDelivery
+	// Deletes the deliveries that are no longer pending and were created
+	// before the given time.
+	PurgeDeliveries(createdBefore time.Time)
+	// Queues a new message, or saves an updated one.
+	PutOutboxMessage(m OutboxMessage)
+	// Retrieves the outbox message with the given ID, or nil.
+	GetOutboxMessage(id string) *OutboxMessage
+	// Deletes an outbox message.
+	DeleteOutboxMessage(id string)
+	// Retrieves up to limit pending messages whose next attempt is due by
+	// the given time, most overdue first.
+	DueOutboxMessages(due time.Time, limit int) []OutboxMessage
+	// Retrieves up to limit dead-lettered messages, most recent first.
+	DeadOutboxMessages(limit int) []OutboxMessage
+	// Deletes the sent messages created before the given time.
+	PurgeOutbox(createdBefore time.Time)
+	// Returns the key used to sign login links and cookies, generating
+	// one the first time it's needed.
+	SigningKey() []byte
+	// Drops any cached user info.
+	FlushUserCache()
+}
+
+var (
+	// Returned (inside an *appError) by UpdateStory when the part being
+	// written is no longer the story's next part.
+	errConcurrentPart = errors.New("Part was written concurrently.")
+	// Used when a story ID being allocated is already in use.
+	errKeyTaken = errors.New("Key already taken")
+	// Used when updating a story that isn't in the store.
+	errNoSuchStory = errors.New("No such story")
+)
+
+// Retrieves the summaries of all in-progress stories for the given author.
+func inProgressStories(s StoryStore, author string) []InProgressStory {
+	stories := s.InProgressStories(author)
+	inProgress := make([]InProgressStory, len(stories))
+	for i, story := range stories {
+		inProgress[i] = story.InProgress(author)
+		inProgress[i].RewriteAuthors(nameFunc(s))
+	}
+	return inProgress
+}
+
+// ByTime implements sort.Interface for []Story based on the Modified field (descending).
+type byTime []Story
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Modified.Before(a[j].Modified) }
+
+// Generates a random string of lowercase letters and numbers of the given length.
+func randomString(l int) string {
+	b := make([]byte, 2*l)
+	rand.Read(b)
+	s := base64.StdEncoding.EncodeToString(b)
+	s = strings.Replace(s, "+", "", -1)
+	s = strings.Replace(s, "/", "", -1)
+	s = strings.Replace(s, "=", "", -1)
+	s = strings.ToLower(s)
+	if len(s) > l {
+		s = s[:l]
+	}
+	// TODO(sdh): if the length is too short, add more.
+	return s
+}
+
+// Settings for a new story, chosen on the begin page.
+type storyOptions struct {
+	// Total number of words in the story.
+	Words int
+	// How the next author is chosen.
+	TurnOrder string
+	// How the story ends, and the rule's count or deadline.
+	EndRule  string
+	EndCount int
+	Deadline time.Time
+	// Hours of inactivity before reminding the next author, or 0.
+	ReminderHours int
+	// Hours of inactivity before skipping the next author, or 0.
+	TimeoutHours int
+	// How much of each part the next author sees, and in
+	// visibleWordsMode how many words (or 0 for the default).
+	VisibleMode  string
+	VisibleWords int
+	// Limits on each part's length, in LengthUnit (0 for the defaults),
+	// and the number of words each author is asked for (or 0).
+	LengthUnit string
+	MinLength  int
+	MaxLength  int
+	WordQuota  int
+}
+
+// Makes a new story and saves it to the store, along with the message
+// telling the first author it's their turn.  Returns the new story.
+func newStory(r request, authors []*mail.Address, opts storyOptions) Story {
+	u, _ := r.user()
+	if u == nil {
+		panic(fmt.Errorf("Must be logged in to start a new story."))
+	}
+	addrs := make([]string, len(authors))
+	parts := make([]StoryPart, 0)
+	found := false
+	for i, author := range authors {
+		if author.Name != "" {
+			putNameForEmailIfAbsent(r.store(), author.Name, author.Address)
+		}
+		addrs[i] = author.Address
+		found = found || author.Address == u.Email
+	}
+	if !found {
+		panic(errorResponse{400, "Error: New stories must include yourself as an author."})
+	}
+	switch opts.VisibleMode {
+	case visibleWordsMode, visibleSentenceMode, visibleLineMode:
+	default:
+		panic(errorResponse{400, "Error: Unknown visible mode: " + opts.VisibleMode})
+	}
+	if opts.VisibleWords < 0 || opts.VisibleWords > maxVisibleWords {
+		panic(errorResponse{400, fmt.Sprintf("Error: The next author may see at most %d words.", maxVisibleWords)})
+	}
+	limits := Story{LengthUnit: opts.LengthUnit, MinLength: opts.MinLength, MaxLength: opts.MaxLength}
+	limit := maxPartLength
+	switch opts.LengthUnit {
+	case charactersUnit:
+	case wordsUnit:
+		limit = maxPartWords
+	default:
+		panic(errorResponse{400, "Error: Unknown length unit: " + opts.LengthUnit})
+	}
+	if opts.MaxLength < 0 || opts.MaxLength > limit {
+		panic(errorResponse{400, fmt.Sprintf("Error: Parts may be at most %d %s long.", limit, limits.LengthUnitName())})
+	} else if opts.MinLength < 0 || opts.MinLength > limits.MaxPartLength() {
+		panic(errorResponse{400, "Error: The minimum length of a part must not be more than the maximum."})
+	}
+	if _, ok := turnOrders[opts.TurnOrder]; !ok {
+		panic(errorResponse{400, "Error: Unknown turn order: " + opts.TurnOrder})
+	}
+	switch opts.EndRule {
+	case endAtWords:
+		if opts.Words < 1 {
+			panic(errorResponse{400, "Error: Please say how many words the story should have."})
+		}
+	case endAfterRounds, endAfterParts:
+		if opts.EndCount < 1 {
+			panic(errorResponse{400, "Error: Please say how many " + opts.EndRule + " the story should have."})
+		}
+	case endAtDeadline:
+		if !opts.Deadline.After(time.Now()) {
+			panic(errorResponse{400, "Error: The story's deadline must be in the future."})
+		}
+	default:
+		if _, ok := completionPolicies[opts.EndRule]; !ok {
+			panic(errorResponse{400, "Error: Unknown completion rule: " + opts.EndRule})
+		}
+	}
+	if opts.WordQuota < 0 || opts.WordQuota > maxPartWords {
+		panic(errorResponse{400, fmt.Sprintf("Error: The word quota may be at most %d words.", maxPartWords)})
+	}
+	now := time.Now()
+	story := &Story{
+		Created:   now,
+		Creator:   u.Email,
+		NextId:    randomString(8),
+		Modified:  now,
+		Complete:  false,
+		Parts:     parts,
+		Authors:   addrs,
+		TurnOrder: opts.TurnOrder,
+		Words:     opts.Words,
+		EndRule:   opts.EndRule,
+		EndCount:  opts.EndCount,
+		Deadline:  opts.Deadline,
+
+		VisibleMode:   opts.VisibleMode,
+		VisibleWords:  opts.VisibleWords,
+		LengthUnit:    opts.LengthUnit,
+		MinLength:     opts.MinLength,
+		MaxLength:     opts.MaxLength,
+		WordQuota:     opts.WordQuota,
+		ReminderHours: opts.ReminderHours,
+		TimeoutHours:  opts.TimeoutHours,
+	}
+	story.NextAuthor = story.turnOrder().first(story)
+	r.store().PutNewStory(story, 3, func(story Story) Queued {
+		queued := Queued{Deliveries: append(eventDeliveries(r.store(), eventStoryCreated, story, u.Email),
+			eventDeliveries(r.store(), eventTurnAssigned, story, story.NextAuthor)...)}
+		// The creator is looking at the story already.
+		if story.NextAuthor != u.Email {
+			queued.Outbox = maybeTurnMail(r, story)
+		}
+		return queued
+	})
+	if story.Id == "" {
+		panic(&appError{fmt.Errorf("No ID assigned to new story"), "Failed to save story", http.StatusInternalServerError})
+	}
+	return *story
+}
+
+// Returns the next author in the cycle, panics if the
+// current author is not found.
+func findNextAuthor(authors []string, author string) string {
+	for i, a := range authors {
+		if a == author {
+			return authors[(i+1)%len(authors)]
+		}
+	}
+	panic(fmt.Errorf("Could not find author %s in author list %s", author, authors))
+}
+
+const (
+	// Longest part, unless the story says otherwise.
+	defaultMaxPartLength = 500
+	defaultMaxPartWords  = 100
+	// Longest part any story may allow, in characters or words.
+	maxPartLength = 5000
+	maxPartWords  = 1000
+	// Most characters in any part, whatever its unit, which leaves room
+	// for maxPartWords of even quite long words.
+	maxPartCharacters = 20 * maxPartWords
+	// Number of words of a part the next author sees, unless the story
+	// says otherwise.
+	defaultVisibleWords = 16
+	// Most words of a part a story may let the next author see.
+	maxVisibleWords = 100
+)
+
+// Appends a part to the story and saves it to the store, along with the
+// message telling the next author it's their turn.  Panics in case of an
+// error.
+func savePart(r request, story *Story, text string) {
+	s := r.store()
+	var part StoryPart
+	now := time.Now()
+	closing := story.ClosingTurn()
+
+	part.Id = story.NextId
+	story.NextId = randomString(8)
+	part.Author = story.NextAuthor
+	story.advanceTurn()
+	part.Written = now
+	story.Modified = now
+	part.Hidden, part.Visible = story.splitPart(text)
+	story.Parts = append(story.Parts, part)
+	if closing || story.completion().complete(*story, text) {
+		story.Complete = true
+	}
+	var queued Queued
+	if story.NextAuthor != part.Author {
+		queued.Outbox = maybeTurnMail(r, *story)
+	}
+	queued.Deliveries = eventDeliveries(s, eventPartWritten, *story, part.Author)
+	if story.Complete {
+		queued.Deliveries = append(queued.Deliveries, eventDeliveries(s, eventStoryCompleted, *story, "")...)
+	} else {
+		queued.Deliveries = append(queued.Deliveries, eventDeliveries(s, eventTurnAssigned, *story, story.NextAuthor)...)
+	}
+	s.UpdateStory(story, part.Id, queued)
+}
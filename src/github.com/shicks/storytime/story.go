@@ -1,8 +1,12 @@
 package storytime
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type hasId interface {
@@ -30,11 +34,73 @@ type Story struct {
 	Parts []StoryPart
 	// Email addresses of each author.
 	Authors []string
+	// How the next author is chosen; one of the turn orders in turnorder.go.
+	TurnOrder string
+	// For orderShuffled, the authors yet to take a turn this round, in order.
+	Round []string
 	// Total number of words in the story.  Once the story
-	// reaches this length (or longer), it will be closed.
+	// reaches this length (or longer), it will be closed, if its
+	// EndRule is endAtWords.
 	Words int
+	// How the story ends; one of the completion rules in ending.go.
+	EndRule string
+	// For endAfterRounds and endAfterParts, how many rounds or parts.
+	EndCount int
+	// For endAtDeadline, when the story ends.
+	Deadline time.Time
+	// How much of each part the next author sees: visibleWordsMode,
+	// visibleSentenceMode or visibleLineMode.
+	VisibleMode string
+	// In visibleWordsMode, how many words of the last line the next author
+	// sees, or 0 for defaultVisibleWords.
+	VisibleWords int
+	// Whether MinLength and MaxLength count charactersUnit or wordsUnit.
+	LengthUnit string
+	// Shortest allowed part, or 0 for no minimum.
+	MinLength int
+	// Longest allowed part, or 0 for the unit's default.
+	MaxLength int
+	// How many words each author is asked to write, or 0 for no quota.
+	// Unlike the length limits, the quota isn't enforced.
+	WordQuota int
+	// Hours of inactivity before the next author is reminded, or 0 for never.
+	ReminderHours int
+	// Hours of inactivity before the next author is skipped, or 0 for never.
+	TimeoutHours int
+	// When the last reminder was sent.
+	LastReminder time.Time
+	// Skips and other changes to the authors, oldest first.
+	History []StoryEvent
+	// When the story was deleted, or the zero time.  Deleted stories may
+	// be restored until they're purged, deleteUndoWindow later.
+	Deleted time.Time
+	// Whether the story was abandoned before it was complete.
+	Archived bool
 }
 
+// How much of each part is passed on to the next author.
+const (
+	// The last VisibleWords words of the last line.
+	visibleWordsMode = ""
+	// The last sentence, which may span lines.
+	visibleSentenceMode = "sentence"
+	// The whole of the last line.
+	visibleLineMode = "line"
+)
+
+// Units for the limits on a part's length.
+const (
+	charactersUnit = ""
+	wordsUnit      = "words"
+)
+
+const (
+	// How long a deleted story may be restored before it's purged.
+	deleteUndoWindow = week
+	// How long the link for a turn works, if the turn never times out.
+	turnLinkLifetime = month
+)
+
 func (s *Story) SetId(id string) {
 	s.Id = id
 }
@@ -51,6 +117,261 @@ func (s *Story) RewriteAuthors(rewriter func(string) string) {
 		part.Author = rewriter(part.Author)
 		s.Parts[i] = part
 	}
+	rewriteEvents(s.History, rewriter)
+}
+
+// Records an event in the story's history.
+func (s *Story) addEvent(author, event, by string) {
+	s.History = append(s.History, StoryEvent{time.Now(), author, event, by})
+}
+
+// Returns whether the story is still being written, i.e. it's neither
+// complete, archived nor deleted.
+func (s Story) Active() bool {
+	return !s.Complete && !s.Archived && s.Deleted.IsZero()
+}
+
+// Returns when the link for the current turn stops working on its own:
+// when the turn times out, or turnLinkLifetime after it began.
+func (s Story) TurnExpires() time.Time {
+	if due := s.TimeoutDue(); !due.IsZero() {
+		return due
+	}
+	return s.Modified.Add(turnLinkLifetime)
+}
+
+// Returns how many words of the last line the next author sees, in
+// visibleWordsMode.
+func (s Story) VisibleWordCount() int {
+	if s.VisibleWords == 0 {
+		return defaultVisibleWords
+	}
+	return s.VisibleWords
+}
+
+// Describes how much of a part the next author sees, to complete the
+// sentence "Anything ... will be visible to the next author."
+func (s Story) VisibleDescription() string {
+	switch s.VisibleMode {
+	case visibleSentenceMode:
+		return "in the last sentence"
+	case visibleLineMode:
+		return "on the last line"
+	}
+	return fmt.Sprintf("on the last line (up to %d words)", s.VisibleWordCount())
+}
+
+// Matches the end of a sentence, including any closing quotes or brackets
+// and the space after it.
+var sentenceEnd = regexp.MustCompile(`[.!?]+["'\x{201D}\x{2019})\]]*\s+`)
+
+// Splits the text of a part into the part hidden from the next author
+// and the part they see, according to the story's VisibleMode.  Each is
+// normalized to single spaces between words.  Panics if there's no text.
+func (s Story) splitPart(text string) (hidden, visible string) {
+	lines := SplitterOnAny("\n\r").TrimResults().OmitEmpty().SplitToList(text)
+	if len(lines) < 1 {
+		panic(fmt.Errorf("No text: %s", text))
+	}
+	wordSplitter := SplitterOnAny(" \t").TrimResults().OmitEmpty()
+	normalize := func(s string) string {
+		return strings.Join(wordSplitter.SplitToList(s), " ")
+	}
+	switch s.VisibleMode {
+	case visibleSentenceMode:
+		all := normalize(strings.Join(lines, " "))
+		// The text may not end with a space, so the last match marks the
+		// start of the last sentence.
+		ends := sentenceEnd.FindAllStringIndex(all, -1)
+		if len(ends) == 0 {
+			return "", all
+		}
+		split := ends[len(ends)-1][1]
+		return strings.TrimSpace(all[:split]), all[split:]
+	case visibleLineMode:
+		return normalize(strings.Join(lines[:len(lines)-1], " ")), normalize(lines[len(lines)-1])
+	}
+	hidden = strings.Join(lines[:len(lines)-1], " ")
+	words := wordSplitter.SplitToList(lines[len(lines)-1])
+	if count := s.VisibleWordCount(); len(words) > count {
+		hidden += " " + strings.Join(words[:len(words)-count], " ")
+		words = words[len(words)-count:]
+	}
+	return normalize(hidden), strings.Join(words, " ")
+}
+
+// Returns the longest allowed part, in LengthUnit.
+func (s Story) MaxPartLength() int {
+	switch {
+	case s.MaxLength != 0:
+		return s.MaxLength
+	case s.LengthUnit == wordsUnit:
+		return defaultMaxPartWords
+	}
+	return defaultMaxPartLength
+}
+
+// Returns the name of the LengthUnit, for messages.
+func (s Story) LengthUnitName() string {
+	if s.LengthUnit == wordsUnit {
+		return "words"
+	}
+	return "characters"
+}
+
+// Returns the length of the text, in LengthUnit.
+func (s Story) partLength(text string) int {
+	if s.LengthUnit == wordsUnit {
+		return countWords(text)
+	}
+	return utf8.RuneCountInString(text)
+}
+
+// Returns the number of words in the text.
+func countWords(text string) int {
+	return len(SplitterOnAny("\n\r\t ").TrimResults().OmitEmpty().SplitToList(text))
+}
+
+// Describes the limits on a part's length.
+func (s Story) LengthDescription() string {
+	if s.MinLength > 0 {
+		return fmt.Sprintf("Each part must be between %d and %d %s long.", s.MinLength, s.MaxPartLength(), s.LengthUnitName())
+	}
+	return fmt.Sprintf("Each part may be at most %d %s long.", s.MaxPartLength(), s.LengthUnitName())
+}
+
+// Returns what's wrong with the length of the text as a part of the
+// story, or "" if nothing is.
+func (s Story) checkPartLength(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return "Please write something before submitting."
+	} else if n := utf8.RuneCountInString(text); n > maxPartCharacters {
+		return fmt.Sprintf("Your part is too long: no part may be more than %d characters.", maxPartCharacters)
+	}
+	if max := s.ClosingMaxWords(); max > 0 {
+		if n := countWords(text); n > max {
+			return fmt.Sprintf("Yours is the last part of the story, so it may be at most %d words long, "+
+				"but it's %d.  Please bring it to a close a little sooner.", max, n)
+		}
+	}
+	n := s.partLength(text)
+	if n > s.MaxPartLength() {
+		return fmt.Sprintf("Your part is %d %s long, but the most allowed is %d.  Please shorten it.",
+			n, s.LengthUnitName(), s.MaxPartLength())
+	} else if n < s.MinLength {
+		return fmt.Sprintf("Your part is %d %s long, but the least allowed is %d.  Please write a little more.",
+			n, s.LengthUnitName(), s.MinLength)
+	}
+	return ""
+}
+
+// Returns when a deleted story will be purged.
+func (s Story) PurgeTime() time.Time {
+	return s.Deleted.Add(deleteUndoWindow)
+}
+
+// Returns whether the given email is one of the story's authors.
+func (s Story) HasAuthor(author string) bool {
+	for _, a := range s.Authors {
+		if a == author {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether an email address, in any case, is one of the story's
+// authors.
+func (s Story) hasAuthorAddress(address string) bool {
+	for _, a := range s.Authors {
+		if strings.EqualFold(a, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Skips the next author's turn, passing it on to the following author.
+// The old link for writing the next part stops working.
+func (s *Story) SkipNextAuthor() {
+	s.advanceTurn()
+	s.NextId = randomString(8)
+	s.Modified = time.Now()
+}
+
+// Removes an author from the story entirely, skipping them first if
+// it's their turn.  The last author cannot be removed.
+func (s *Story) RemoveAuthor(author string) error {
+	if !s.HasAuthor(author) {
+		return errors.New("Not an author: " + author)
+	} else if len(s.Authors) == 1 {
+		return errors.New("Cannot remove the only author")
+	}
+	if s.NextAuthor == author {
+		s.SkipNextAuthor()
+	}
+	authors := make([]string, 0, len(s.Authors)-1)
+	for _, a := range s.Authors {
+		if a != author {
+			authors = append(authors, a)
+		}
+	}
+	s.Authors = authors
+	s.Modified = time.Now()
+	return nil
+}
+
+// Changes the order authors take turns in.  The new order must contain
+// exactly the same authors.  It remains the current next author's turn.
+func (s *Story) ReorderAuthors(order []string) error {
+	if len(order) != len(s.Authors) {
+		return errors.New("New order must list every author exactly once")
+	}
+	seen := make(map[string]bool)
+	for _, a := range order {
+		if !s.HasAuthor(a) || seen[a] {
+			return errors.New("New order must list every author exactly once")
+		}
+		seen[a] = true
+	}
+	s.Authors = append([]string(nil), order...)
+	s.Modified = time.Now()
+	return nil
+}
+
+// Returns when the next author will be reminded, or the zero time
+// if they won't be (again).
+func (s Story) ReminderDue() time.Time {
+	if s.ReminderHours <= 0 || s.LastReminder.After(s.Modified) {
+		return time.Time{}
+	}
+	return s.Modified.Add(time.Duration(s.ReminderHours) * time.Hour)
+}
+
+// Returns when the next author will be skipped, or the zero time if never.
+func (s Story) TimeoutDue() time.Time {
+	if s.TimeoutHours <= 0 || len(s.Authors) < 2 {
+		return time.Time{}
+	}
+	return s.Modified.Add(time.Duration(s.TimeoutHours) * time.Hour)
+}
+
+// Returns the earliest time the given author may nudge the next author.
+// Only nudges during the current turn count.
+func (s Story) NextNudge(by string) time.Time {
+	var next time.Time
+	for _, e := range s.History {
+		if e.Event != eventNudged || e.Author != s.NextAuthor || e.Time.Before(s.Modified) {
+			continue
+		}
+		if t := e.Time.Add(nudgeInterval); t.After(next) {
+			next = t
+		}
+		if t := e.Time.Add(authorNudgeInterval); e.By == by && t.After(next) {
+			next = t
+		}
+	}
+	return next
 }
 
 // Returns the total number of words in this story, so far.
@@ -106,9 +427,12 @@ func (s Story) InProgress(author string) InProgressStory {
 		NextAuthor:  s.NextAuthor,
 		Modified:    s.Modified,
 		LastWritten: s.InProgressSnippet(author),
-		Authors:     s.Authors,
+		Authors:     append([]string(nil), s.Authors...), // RewriteAuthors changes these
 		Words:       s.Words,
 		WordsLeft:   s.WordsLeft(),
+		Ending:      s.EndDescription(),
+		TimeoutDue:  s.TimeoutDue(),
+		History:     append([]StoryEvent(nil), s.History...),
 	}
 	if len(s.Parts) > 0 {
 		inProgress.LastAuthor = s.Parts[len(s.Parts)-1].Author
@@ -142,9 +466,9 @@ type StoryPart struct {
 	// The ID of this part.
 	Id string
 	// Text that the next writer does not get to see.
-	Hidden string
+	Hidden string `datastore:",noindex"`
 	// Text that the next writer does get to see.
-	Visible string
+	Visible string `datastore:",noindex"`
 	// The time that this part was written.
 	Written time.Time
 	// Author that contributed this part.
@@ -159,6 +483,71 @@ func (s StoryPart) GetId() string {
 	return s.Id
 }
 
+// Kinds of events in a story's history.
+const (
+	eventSkipped   = "skipped"
+	eventTimedOut  = "timedout"
+	eventRemoved   = "removed"
+	eventReordered = "reordered"
+	eventNudged    = "nudged"
+	eventArchived  = "archived"
+	eventDeleted   = "deleted"
+	eventRestored  = "restored"
+	eventEnded     = "ended"
+)
+
+var eventDescriptions = map[string]string{
+	eventSkipped:   "Turn skipped",
+	eventTimedOut:  "Turn timed out",
+	eventRemoved:   "Removed from the story",
+	eventReordered: "Authors reordered",
+	eventNudged:    "Nudged",
+	eventArchived:  "Story archived",
+	eventDeleted:   "Story deleted",
+	eventRestored:  "Story restored",
+	eventEnded:     "Story ended",
+}
+
+const (
+	// Minimum time between nudges of the same turn, by anyone.
+	nudgeInterval = time.Hour
+	// Minimum time between nudges of the same turn by the same author.
+	authorNudgeInterval = 24 * time.Hour
+)
+
+// Something that happened to a story, other than a part being written.
+type StoryEvent struct {
+	// The time of the event.
+	Time time.Time
+	// Email address of the author the event happened to, if any.
+	Author string
+	// What happened: one of the event constants, e.g. eventSkipped.
+	Event string
+	// Email address of whoever caused the event, or empty if it was
+	// automatic.
+	By string
+}
+
+// Returns a human-readable description of the event.
+func (e StoryEvent) Description() string {
+	if description, ok := eventDescriptions[e.Event]; ok {
+		return description
+	}
+	return e.Event
+}
+
+func rewriteEvents(events []StoryEvent, rewriter func(string) string) {
+	for i, event := range events {
+		if event.Author != "" {
+			event.Author = rewriter(event.Author)
+		}
+		if event.By != "" {
+			event.By = rewriter(event.By)
+		}
+		events[i] = event
+	}
+}
+
 // This kind is used to quickly access all current stories for a given author.
 type StoryAuthor struct {
 	// Name of the author.
@@ -190,6 +579,12 @@ type InProgressStory struct {
 	Words int
 	// Words remaining in the story.
 	WordsLeft int
+	// How the story will end.
+	Ending string
+	// When the next author will be skipped, or the zero time if never.
+	TimeoutDue time.Time
+	// Skips and other changes to the authors, oldest first.
+	History []StoryEvent
 }
 
 // Rewrites the authors with real names if available.
@@ -200,4 +595,5 @@ func (s *InProgressStory) RewriteAuthors(rewriter func(string) string) {
 	for i, author := range s.Authors {
 		s.Authors[i] = rewriter(author)
 	}
+	rewriteEvents(s.History, rewriter)
 }
@@ -0,0 +1,66 @@
+package storytime
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitPart(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		words         int
+		text          string
+		hidden, shown string
+	}{
+		{"words: short line", visibleWordsMode, 0, "The cat sat.", "", "The cat sat."},
+		{"words: last line only", visibleWordsMode, 0, "The cat sat.\nThen it slept.", "The cat sat.", "Then it slept."},
+		{"words: long line", visibleWordsMode, 2, "The cat sat\non  the   mat all day", "The cat sat on the mat", "all day"},
+		{"words: default count", visibleWordsMode, 0, strings.Repeat("word ", 20), strings.TrimSpace(strings.Repeat("word ", 4)),
+			strings.TrimSpace(strings.Repeat("word ", 16))},
+		{"sentence", visibleSentenceMode, 0, "The cat sat.  Then it\nslept on the mat", "The cat sat.", "Then it slept on the mat"},
+		{"sentence: ends with a stop", visibleSentenceMode, 0, "The cat sat. Then it slept.", "The cat sat.", "Then it slept."},
+		{"sentence: closing quote", visibleSentenceMode, 0, `"Sit," it said. "Now!" Then it slept.`, `"Sit," it said. "Now!"`, "Then it slept."},
+		{"sentence: only one", visibleSentenceMode, 0, "The cat sat on the mat", "", "The cat sat on the mat"},
+		{"line", visibleLineMode, 0, "The cat sat.\n\nThen  it slept.", "The cat sat.", "Then it slept."},
+		{"line: only one", visibleLineMode, 0, "The cat sat.", "", "The cat sat."},
+	}
+	for _, test := range tests {
+		s := Story{VisibleMode: test.mode, VisibleWords: test.words}
+		hidden, shown := s.splitPart(test.text)
+		if hidden != test.hidden || shown != test.shown {
+			t.Errorf("%s: splitPart(%q) = %q, %q, want %q, %q", test.name, test.text, hidden, shown, test.hidden, test.shown)
+		}
+	}
+}
+
+func TestCheckPartLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		story Story
+		text  string
+		ok    bool
+	}{
+		{"empty", Story{EndRule: endByCreator}, "  \n", false},
+		{"default limit", Story{EndRule: endByCreator}, strings.Repeat("a", defaultMaxPartLength), true},
+		{"over default limit", Story{EndRule: endByCreator}, strings.Repeat("a", defaultMaxPartLength+1), false},
+		{"characters, not bytes", Story{EndRule: endByCreator, MaxLength: 10}, "éééééééééé", true},
+		{"too short", Story{EndRule: endByCreator, MinLength: 5}, "abc", false},
+		{"words", Story{EndRule: endByCreator, LengthUnit: wordsUnit, MaxLength: 3}, "one two three", true},
+		{"too many words", Story{EndRule: endByCreator, LengthUnit: wordsUnit, MaxLength: 3}, "one two three four", false},
+		{"long words", Story{EndRule: endByCreator, LengthUnit: wordsUnit, MaxLength: maxPartWords},
+			strings.Repeat("extraordinarily ", maxPartWords), true},
+		{"over the hard cap", Story{EndRule: endByCreator, LengthUnit: wordsUnit, MaxLength: maxPartWords},
+			strings.Repeat("a", maxPartCharacters+1), false},
+		{"closing turn", Story{Words: 50, Parts: []StoryPart{{Visible: strings.Repeat("word ", 40)}}},
+			strings.Repeat("word ", 10+closingOverrun), true},
+		{"closing turn overrun", Story{Words: 50, Parts: []StoryPart{{Visible: strings.Repeat("word ", 40)}}},
+			strings.Repeat("word ", 10+closingOverrun+1), false},
+	}
+	for _, test := range tests {
+		problem := test.story.checkPartLength(test.text)
+		if ok := problem == ""; ok != test.ok {
+			t.Errorf("%s: checkPartLength = %q, want ok = %v", test.name, problem, test.ok)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package storytime
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"net/mail"
 	"strconv"
@@ -9,25 +10,13 @@ import (
 	"time"
 )
 
-func init() {
-	http.Handle("/", appHandler(root))
-	http.Handle("/begin", appHandler(begin))
-	http.Handle("/completed", appHandler(completed))
-	http.Handle("/story/", appHandler(story))
-	http.Handle("/write/", appHandler(write))
-
-	// TODO(sdh): remove this handler in prod
-	http.Handle("/clear", appHandler(clearAll))
-	http.Handle("/repair", appHandler(repairAll))
-}
-
 func clearAll(r request) response {
 	u := r.userRequired()
 	if !u.Admin {
 		return notFound
 	}
-	clearDatastore(r.ctx())
-	flushUserCache(r.ctx())
+	r.store().Clear()
+	r.store().FlushUserCache()
 	return errorResponse{200, "OK"}
 }
 
@@ -49,12 +38,12 @@ func root(r request) response {
 
 	// Build up the response.
 	var root rootPage
-	root.RecentlyCompleted = completedStories(r.ctx(), 5, time.Now())
+	root.RecentlyCompleted = r.store().CompletedStories(5, time.Now())
 	u, url := r.user()
 	if u != nil {
 		root.Author = u.Email
-		root.CurrentStory = currentStory(r.ctx(), u.Email)
-		root.InProgress = inProgressStories(r.ctx(), u.Email)
+		root.CurrentStory = r.store().CurrentStory(u.Email)
+		root.InProgress = inProgressStories(r.store(), u.Email)
 	} else {
 		root.LoginLink = url
 	}
@@ -78,8 +67,15 @@ func begin(r request) response {
 
 // Begins a new story with the given form inputs (authors, words)
 func beginPost(r request) response {
-	authorList := strings.Join(
-		SplitterOnAny(",\n\r").TrimResults().OmitEmpty().SplitToList(r.req.FormValue("authors")), ",")
+	authors := parseAuthors(r.req.FormValue("authors"))
+	story := newStory(r, authors, parseStoryOptions(r))
+	// Now issue the redirect.
+	return redirect("/story/" + story.Id)
+}
+
+// Parses a comma- or newline-separated list of authors.
+func parseAuthors(list string) []*mail.Address {
+	authorList := strings.Join(SplitterOnAny(",\n\r").TrimResults().OmitEmpty().SplitToList(list), ",")
 	authors, err := mail.ParseAddressList(authorList)
 	if err != nil {
 		panic(&appError{err, "Could not parse author email addresses: " + authorList, http.StatusBadRequest})
@@ -87,17 +83,46 @@ func beginPost(r request) response {
 	if len(authors) == 0 {
 		panic(&appError{errors.New("No authors"), "No authors", http.StatusBadRequest})
 	}
-	words, err := strconv.ParseUint(r.req.FormValue("words"), 10, 16)
-	if err != nil {
-		panic(&appError{err, "Could not parse word count as an integer", http.StatusBadRequest})
+	return authors
+}
+
+// Reads the story settings from the begin form.
+func parseStoryOptions(r request) storyOptions {
+	var opts storyOptions
+	opts.Words = parseIntField(r, "words", "word count")
+	opts.TurnOrder = r.req.FormValue("turn_order")
+	opts.EndRule = r.req.FormValue("end_rule")
+	opts.EndCount = parseIntField(r, "end_count", "number of "+opts.EndRule)
+	if deadline := strings.TrimSpace(r.req.FormValue("deadline")); deadline != "" {
+		day, err := time.Parse("2006-01-02", deadline)
+		if err != nil {
+			panic(errorResponse{http.StatusBadRequest, "Could not parse the deadline as a date"})
+		}
+		// The story ends at the end of the day.
+		opts.Deadline = day.Add(24 * time.Hour)
 	}
-	story := newStory(r, authors, int(words))
-	user, _ := r.user()
-	if user == nil || story.NextAuthor != user.Email {
-		maybeSendMail(r.ctx(), story)
+	opts.ReminderHours = parseIntField(r, "reminder", "reminder hours")
+	opts.TimeoutHours = parseIntField(r, "timeout", "timeout hours")
+	opts.VisibleMode = r.req.FormValue("visible_mode")
+	opts.VisibleWords = parseIntField(r, "visible_words", "visible words")
+	opts.LengthUnit = r.req.FormValue("length_unit")
+	opts.MinLength = parseIntField(r, "min_length", "minimum length")
+	opts.MaxLength = parseIntField(r, "max_length", "maximum length")
+	opts.WordQuota = parseIntField(r, "word_quota", "word quota")
+	return opts
+}
+
+// Parses a non-negative integer form field.  An empty field is 0.
+func parseIntField(r request, field, description string) int {
+	value := strings.TrimSpace(r.req.FormValue(field))
+	if value == "" {
+		return 0
 	}
-	// Now issue the redirect.
-	return redirect("/story/" + story.Id)
+	i, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		panic(errorResponse{http.StatusBadRequest, "Could not parse " + description + " as an integer"})
+	}
+	return int(i)
 }
 
 func completed(r request) response {
@@ -110,7 +135,7 @@ func completed(r request) response {
 			olderThan = time.Unix(beforeSeconds, 0)
 		}
 	}
-	return execute(&completedPage{completedStories(r.ctx(), 50, olderThan)})
+	return execute(&completedPage{r.store().CompletedStories(50, olderThan)})
 }
 
 // Handles URLs of the form /story/storyID or /story/storyID/partID
@@ -131,18 +156,27 @@ func story(r request) response {
 	// We're looking at a story, so the behavior depends on the status/user.
 	// We need to look up the story and the last part to find out where it's at.
 	id := (*args)["storyId"]
-	story := fetchStory(r.ctx(), id)
+	story := r.store().FetchStory(id)
 	if story == nil {
 		return errorResponse{404, "Not Found: no such id"} // notFound
 	}
+	u, _ := r.user()
+
+	// Deleted stories are only visible to whoever can restore them.
+	if !story.Deleted.IsZero() {
+		if u != nil && canDelete(u, *story) {
+			return execute(&deletedPage{*story})
+		}
+		return errorResponse{404, "Not Found: no such id"} // notFound
+	}
 
-	// If the story is complete, display it.
-	if story.Complete {
+	// If the story is complete (or abandoned), display it.  Abandoned
+	// stories still keep their hidden text hidden, as the API does.
+	if story.Complete || story.Archived {
 		return displayStory(r, *story)
 	}
 
 	// Otherwise, if the current user is the next author, then show continue page
-	u, _ := r.user()
 	if u != nil {
 		if story.NextAuthor == u.Email {
 			return redirect("/story/" + id + "/" + story.NextId)
@@ -169,10 +203,66 @@ func write(r request) response {
 	return writePart(r, (*args)["storyId"], (*args)["partId"], text)
 }
 
+// Handles replies to notification emails, which App Engine posts to
+// /_ah/mail/address.  The address identifies the story and part, and
+// the sender must be the story's next author.  Like the link to write a
+// part, the address stops working when the turn expires.  Since anyone
+// can forge the sender, only the story's own authors are ever told why
+// their reply was rejected.
+func receiveMail(r request) response {
+	args := r.matchPath("/_ah/mail/:address")
+	if args == nil || !host.isMail(r.req) {
+		return notFound
+	}
+	ok := errorResponse{200, "OK"} // there's no one to show errors to
+	storyId, partId, valid := parseReplyAddress((*args)["address"])
+	if !valid {
+		r.errorf("Mail sent to unknown address: %s", (*args)["address"])
+		return ok
+	}
+	from, text, err := parseReply(r.req.Body)
+	if err != nil {
+		r.errorf("Could not parse reply for story %s: %v", storyId, err)
+		return ok
+	}
+	story := r.store().FetchStory(storyId)
+	if story == nil || !story.Active() || story.NextId != partId {
+		r.errorf("Reply from %s for stale part %s/%s", from, storyId, partId)
+		if story != nil && story.hasAuthorAddress(from) {
+			sendRejection(r, from, "This part of the story has already been written.")
+		}
+		return ok
+	} else if !strings.EqualFold(from, story.NextAuthor) {
+		r.errorf("Reply from %s for %s/%s, expected %s", from, storyId, partId, story.NextAuthor)
+		return ok
+	} else if time.Now().After(story.TurnExpires()) {
+		r.errorf("Reply from %s for expired part %s/%s", from, storyId, partId)
+		sendRejection(r, from, fmt.Sprintf("This reply address has expired.  Please sign in at %s to write your part.",
+			continueUrl(*story)))
+		return ok
+	}
+	if strings.TrimSpace(text) == "" {
+		sendRejection(r, from, "Your reply was empty.  Please write your part above the quoted text.")
+		return ok
+	} else if problem := story.checkPartLength(text); problem != "" {
+		sendRejection(r, from, fmt.Sprintf("%s  Please try again.\n\n> %s", problem, text))
+		return ok
+	}
+	author := story.NextAuthor
+	savePart(r, story, text)
+	// Since they're writing by email, send the author their next story, too.
+	if next := r.store().CurrentStory(author); next != nil {
+		sendMail(r, *next)
+	}
+	return ok
+}
+
 func continueStory(r request, storyId, partId string) response {
-	story := fetchStory(r.ctx(), storyId)
-	if story == nil {
-		return errorResponse{404, "Not Found: no such story"}
+	story := r.store().FetchStory(storyId)
+	if story == nil || !story.Deleted.IsZero() {
+		return &errorPage{Code: 404, Message: "There is no such story."}
+	} else if !story.Active() {
+		return redirect("/story/" + story.Id)
 	} else if story.NextId != partId {
 		// If this is an out-of-date partId, redirect to the story status
 		for _, part := range story.Parts {
@@ -180,49 +270,111 @@ func continueStory(r request, storyId, partId string) response {
 				return storyStatus(r, *story, part.Author)
 			}
 		}
-		return errorResponse{404, "Not Found: wrong part: " + story.NextId} // notFound
+		return &errorPage{Code: 404, Message: "This link isn't for any part of the story."}
+	}
+	if denied := authorizeTurn(r, *story); denied != nil {
+		return denied
+	}
+	story.RewriteAuthors(nameFunc(r.store()))
+	return execute(&continuePage{CurrentStory: story})
+}
+
+// Checks that the request may write the story's current turn, and
+// returns an error page if not.  The part ID in the URL is a bearer
+// token for exactly one turn: it stops working once the part is written
+// (since the story gets a new NextId) or the turn expires.  Logged-in
+// users must also be the next author; anyone else is turned away even
+// if they have the link.
+func authorizeTurn(r request, story Story) *errorPage {
+	u, signIn := r.user()
+	if u != nil && u.Email != story.NextAuthor {
+		return &errorPage{Code: 403, Message: "It's not your turn to write this story."}
+	} else if u == nil && time.Now().After(story.TurnExpires()) {
+		return &errorPage{Code: 403, Message: "This link has expired.", SignIn: signIn}
+	}
+	return nil
+}
+
+// Returns the page for a part ID that isn't the story's current turn.
+func turnOver(story Story, partId string) *errorPage {
+	for _, part := range story.Parts {
+		if part.Id == partId {
+			return &errorPage{Code: 410, Message: "This part of the story has already been written."}
+		}
 	}
-	story.RewriteAuthors(nameFunc(r.ctx()))
-	return execute(&continuePage{story})
+	return &errorPage{Code: 404, Message: "This link isn't for any part of the story."}
+}
+
+// Fetches the story whose current turn is partId, as long as the
+// request may write it.  Otherwise returns an error page.
+func turnStory(r request, storyId, partId string) (*Story, *errorPage) {
+	story := r.store().FetchStory(storyId)
+	if story == nil || !story.Deleted.IsZero() {
+		return nil, &errorPage{Code: 404, Message: "There is no such story."}
+	} else if !story.Active() {
+		return nil, &errorPage{Code: 410, Message: "This story is no longer being written."}
+	} else if story.NextId != partId {
+		return nil, turnOver(*story, partId)
+	}
+	if denied := authorizeTurn(r, *story); denied != nil {
+		return nil, denied
+	}
+	return story, nil
 }
 
 func writePart(r request, storyId, partId, text string) response {
-	if len(text) > 500 {
-		return errorResponse{400, "Input too long: 500 characters max."}
+	story, denied := turnStory(r, storyId, partId)
+	if denied != nil {
+		return denied
+	}
+	// Show the page again, with the draft, rather than lose it.
+	if problem := story.checkPartLength(text); problem != "" {
+		story.RewriteAuthors(nameFunc(r.store()))
+		return execute(&continuePage{CurrentStory: story, Draft: text, Problem: problem})
 	}
-	story := fetchStory(r.ctx(), storyId)
 	user, _ := r.user()
 	author := story.NextAuthor
-	if story == nil {
-		return errorResponse{404, "Not Found: no such story"}
-	} else if story.NextId != partId {
-		return errorResponse{404, "Not Found: wrong part: " + story.NextId}
-	}
-	savePart(r.ctx(), story, text)
+	savePart(r, story, text)
 	time.Sleep(500 * time.Millisecond)
 	// If the user is NOT logged in, then we need to send an email with the next part
 	// Also, just redirect there.
-	if user == nil || author != user.Email {
-		nextStory := currentStory(r.ctx(), author)
+	if user == nil {
+		nextStory := r.store().CurrentStory(author)
 		if nextStory != nil && nextStory.NextId != partId {
-			sendMail(r.ctx(), *nextStory)
+			sendMail(r, *nextStory)
 			return redirect("/story/" + nextStory.Id + "/" + nextStory.NextId)
 		}
 	}
-	// Also maybe send an email to the next author of this story
-	if story.NextAuthor != author {
-		maybeSendMail(r.ctx(), *story)
-	}
 	return redirect("/")
 }
 
 func displayStory(r request, story Story) response {
-	story.RewriteAuthors(nameFunc(r.ctx()))
-	return execute(&printStoryPage{story})
+	page := &printStoryPage{Story: story}
+	if !story.Complete {
+		page.Story.Parts = make([]StoryPart, len(story.Parts))
+		for i, part := range story.Parts {
+			part.Hidden = ""
+			page.Story.Parts[i] = part
+		}
+	}
+	if u, _ := r.user(); u != nil {
+		page.CanDelete = canDelete(u, story)
+	}
+	page.Story.RewriteAuthors(nameFunc(r.store()))
+	return execute(page)
 }
 
 func storyStatus(r request, story Story, user string) response {
-	inProgress := story.InProgress(user)
-	inProgress.RewriteAuthors(relativeNameFunc(r.ctx(), user))
-	return execute(&statusPage{inProgress})
+	page := &statusPage{}
+	if u, _ := r.user(); u != nil {
+		if canNudge(u, story) {
+			page.Nudge = newNudgeForm(story, u.Email)
+		}
+		if canManage(u, story) {
+			page.Manage = newManageForm(r, u, story)
+		}
+	}
+	page.Story = story.InProgress(user)
+	page.Story.RewriteAuthors(relativeNameFunc(r.store(), user))
+	return execute(page)
 }
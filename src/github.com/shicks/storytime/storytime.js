@@ -12,6 +12,16 @@ var submitButton = document.getElementById('submit');
 
 var continueText = document.getElementById('continue-text');
 if (continueText) continueText.addEventListener('keyup', update);
+var visibleMode = continueText && continueText.dataset['visibleMode'];
+var visibleWords = continueText && parseInt(continueText.dataset['visibleWords'], 10);
+var lengthUnit = continueText && continueText.dataset['lengthUnit'];
+var minLength = continueText && parseInt(continueText.dataset['minLength'], 10);
+var maxLength = continueText && parseInt(continueText.dataset['maxLength'], 10);
+var closingMaxWords = continueText && parseInt(continueText.dataset['closingMaxWords'], 10);
+var closingTurn = storyWillEnd && storyWillEnd.dataset['closing'] == 'true';
+var lengthProblem = document.getElementById('length-problem');
+// A draft that's shown again needs the feedback straight away.
+if (continueText && continueText.value) update();
 
 function show(elt, enable) {
   if (!elt) return;
@@ -20,19 +30,34 @@ function show(elt, enable) {
 }
 
 function update() {
-  // Update words-remaining
-  var left = wordsRemaining - countWords(continueText.value);
-  show(storyWillEnd, left <= 0);
-  show(wordsRemainingElement, left > 0);
-  wordsRemainingElement.textContent = left + '';
+  // Update words-remaining, if the story ends at a word count
+  if (wordsRemainingElement) {
+    var left = wordsRemaining - countWords(continueText.value);
+    show(storyWillEnd, closingTurn || left <= 0);
+    show(wordsRemainingElement, left > 0);
+    wordsRemainingElement.textContent = left + '';
+  }
 
   // Update next-visible
   if (nextVisible) {
-    nextVisible.textContent = lastWords(continueText.value, 16); // TODO(sdh): inject count
+    nextVisible.textContent = visiblePart(continueText.value, visibleMode, visibleWords);
   }
 
-  // Disable the submit button if story is too long
-  submitButton.disabled = continueText.value.length > 500;
+  // Disable the submit button if the part is too long or too short
+  var unit = lengthUnit == 'words' ? 'words' : 'characters';
+  // Count characters the way the server does, not in UTF-16 units.
+  var length = unit == 'words' ? countWords(continueText.value) : Array.from(continueText.value).length;
+  var closingTooLong = closingMaxWords && countWords(continueText.value) > closingMaxWords;
+  if (closingTooLong) {
+    lengthProblem.textContent = 'This is the last part: please finish within ' + closingMaxWords + ' words.';
+  } else if (length > maxLength) {
+    lengthProblem.textContent = 'Your part is ' + length + ' ' + unit + ' long; the most allowed is ' + maxLength + '.';
+  } else if (length < minLength) {
+    lengthProblem.textContent = 'Your part is ' + length + ' ' + unit + ' long; the least allowed is ' + minLength + '.';
+  } else {
+    lengthProblem.textContent = '';
+  }
+  submitButton.disabled = closingTooLong || length > maxLength || length < minLength;
 }
 
 function countWords(text) {
@@ -40,6 +65,21 @@ function countWords(text) {
   return words[0] ? words.length : 0;
 }
 
+// Mirrors Story.splitPart: what the next author will see of the text.
+function visiblePart(text, mode, count) {
+  if (mode == 'sentence') {
+    var all = text.trim().split(/\s+/).join(' ');
+    var end = /[.!?]+["'\u201d\u2019)\]]*\s+/g;
+    var start = 0;
+    var match;
+    while ((match = end.exec(all))) {
+      start = match.index + match[0].length;
+    }
+    return all.substring(start);
+  }
+  return lastWords(text, mode == 'line' ? Infinity : count);
+}
+
 function lastWords(text, count) {
   var lines = text.split(/\n/);
   for (var i = lines.length - 1; i >= 0; i--) {
@@ -0,0 +1,33 @@
+package storytime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoryPageHidesHiddenText(t *testing.T) {
+	st, _ := setUpTest(nil)
+	tests := []struct {
+		name       string
+		story      Story
+		showHidden bool
+	}{
+		{"complete", Story{Complete: true}, true},
+		{"archived", Story{Archived: true}, false},
+	}
+	for _, test := range tests {
+		s := test.story
+		s.Authors = []string{"a@x.com", "b@x.com"}
+		s.Parts = []StoryPart{{Id: "p1", Hidden: "Once", Visible: "upon a time", Written: time.Now(), Author: "a@x.com"}}
+		st.PutNewStory(&s, 8, func(Story) Queued { return Queued{} })
+		resp, ok := story(newTestRequest("GET", "/story/"+s.Id, nil)).(templateResponse)
+		if !ok {
+			t.Errorf("%s: story page isn't a template", test.name)
+			continue
+		}
+		page := resp.data.(*printStoryPage)
+		if hidden := page.Story.Parts[0].Hidden; (hidden != "") != test.showHidden || page.Story.Parts[0].Visible != "upon a time" {
+			t.Errorf("%s: page shows part %+v, want hidden text shown = %v", test.name, page.Story.Parts[0], test.showHidden)
+		}
+	}
+}
@@ -3,17 +3,44 @@ package storytime
 import (
 	"html/template"
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 )
 
+// Response showing an error as a page, rather than plain text.
+type errorPage struct {
+	Code    int
+	Message string
+	// A sign-in link, if signing in might help.
+	SignIn string
+}
+
+func (p *errorPage) Status() string {
+	return http.StatusText(p.Code)
+}
+
+func (p *errorPage) Write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(p.Code)
+	templateResponse{name: "errorPage", data: p}.Write(w)
+}
+
 type templateResponse struct {
 	name string
 	data interface{}
+	// The token for csrfField to emit.
+	csrf string
 }
 
+// Renders a copy of the templates, since csrfField differs per request
+// (and html/template can't clone templates once they've been executed).
 func (r templateResponse) Write(w http.ResponseWriter) {
-	err := tmpl.ExecuteTemplate(w, r.name, r.data)
+	t, err := tmpl.Clone()
+	if err == nil {
+		err = t.Funcs(template.FuncMap{"csrfField": csrfFieldFunc(r.csrf)}).ExecuteTemplate(w, r.name, r.data)
+	}
 	if err != nil {
 		panic(&appError{err, "Failed to render template", http.StatusInternalServerError})
 	}
@@ -32,18 +59,26 @@ func execute(data interface{}) response {
 	// if name == "" {
 	// 	panic(fmt.Errorf("Invalid data type for template: %v", data))
 	// }
-	return templateResponse{typ.Name(), data}
+	return templateResponse{name: typ.Name(), data: data}
 }
 
-var tmpl = template.Must(template.New("template").
-	Funcs(fmap).
-	ParseFiles("src/github.com/shicks/storytime/template.html"))
+var tmpl *template.Template
+
+// Parses template.html from the given directory.
+func loadTemplates(dir string) {
+	tmpl = template.Must(template.New("template").
+		Funcs(fmap).
+		ParseFiles(filepath.Join(dir, "template.html")))
+}
 
 var fmap = template.FuncMap{
-	"fuzzy": fuzzyTime,
-	"last":  lastStory,
-	"inc":   func(i int) int { return i + 1 },
-	"join":  func(sep string, a []string) string { return strings.Join(a, sep) },
+	// Replaced per request; see templateResponse.
+	"csrfField":  csrfFieldFunc(""),
+	"fuzzy":      fuzzyTime,
+	"fuzzyUntil": fuzzyUntil,
+	"last":       lastStory,
+	"inc":        func(i int) int { return i + 1 },
+	"join":       func(sep string, a []string) string { return strings.Join(a, sep) },
 }
 
 func lastStory(stories []Story) *Story {
@@ -63,6 +98,10 @@ func lastStory(stories []Story) *Story {
 
 type continuePage struct {
 	CurrentStory *Story
+	// What the author wrote, and why it wasn't saved, when it's being
+	// shown again.
+	Draft   string
+	Problem string
 }
 
 type completedPage struct {
@@ -71,6 +110,41 @@ type completedPage struct {
 }
 
 type printStoryPage struct {
+	Story     Story
+	CanDelete bool
+}
+
+type settingsPage struct {
+	Info  UserInfo
+	Saved bool
+	// Whether chat is offered.
+	CanChat bool
+}
+
+type sessionsPage struct {
+	Sessions []Session
+	// The ID of the session making the request, if any.
+	Current string
+}
+
+type apiTokensPage struct {
+	Tokens []APIToken
+	// A token that was just created, to show this once.
+	NewToken string
+	BaseURL  string
+}
+
+type webhooksPage struct {
+	Webhooks []webhookLog
+	// All the events there are, for the subscribe form.
+	Events []string
+}
+
+type outboxPage struct {
+	Dead []OutboxMessage
+}
+
+type deletedPage struct {
 	Story Story
 }
 
@@ -87,6 +161,44 @@ type rootPage struct {
 	RecentlyCompleted []Story
 }
 
+type signinPage struct {
+	Continue      string
+	PlatformLogin string
+	// The address a login link was just sent to.
+	Sent string
+	// The token from a login link that's being followed.
+	Token string
+}
+
+type loginPage struct {
+	Continue string
+}
+
 type statusPage struct {
 	Story InProgressStory
+	// Only set if the user may nudge the next author.
+	Nudge *nudgeForm
+	// Only set if the user may manage the story's authors.
+	Manage *manageForm
+}
+
+type nudgeForm struct {
+	StoryId string
+	NextId  string
+	// When the user may nudge, if not now.
+	NotUntil time.Time
+}
+
+type manageForm struct {
+	StoryId        string
+	NextId         string
+	NextAuthorName string
+	Authors        []namedAuthor
+	// Whether the user may end the story now.
+	CanEnd bool
+}
+
+type namedAuthor struct {
+	Email string
+	Name  string
 }
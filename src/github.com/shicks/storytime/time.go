@@ -14,20 +14,34 @@ func fuzzyTime(t time.Time) string {
 		return "some time in the future"
 	} else if since < 5*time.Second {
 		return "moments ago"
-	} else if since < 90*time.Second {
-		return fmtPlural(int(since.Seconds()), "a second")
-	} else if since < 90*time.Minute {
-		return fmtPlural(int(since.Minutes()), "a minute")
-	} else if since < day {
-		return fmtPlural(int(since.Hours()), "an hour")
-	} else if since < week {
-		return fmtPlural(int(since/day), "a day")
-	} else if since < month {
-		return fmtPlural(int(since/week), "a week")
-	} else if since < year {
-		return fmtPlural(int(since/month), "a month")
+	}
+	return fuzzyDuration(since) + " ago"
+}
+
+// Like fuzzyTime, but for times in the future.
+func fuzzyUntil(t time.Time) string {
+	until := t.Sub(time.Now())
+	if until < 5*time.Second {
+		return "any moment now"
+	}
+	return "in " + fuzzyDuration(until)
+}
+
+func fuzzyDuration(d time.Duration) string {
+	if d < 90*time.Second {
+		return fmtPlural(int(d.Seconds()), "a second")
+	} else if d < 90*time.Minute {
+		return fmtPlural(int(d.Minutes()), "a minute")
+	} else if d < day {
+		return fmtPlural(int(d.Hours()), "an hour")
+	} else if d < week {
+		return fmtPlural(int(d/day), "a day")
+	} else if d < month {
+		return fmtPlural(int(d/week), "a week")
+	} else if d < year {
+		return fmtPlural(int(d/month), "a month")
 	} else {
-		return fmtPlural(int(since/year), "a year")
+		return fmtPlural(int(d/year), "a year")
 	}
 }
 
@@ -40,7 +54,7 @@ const (
 
 func fmtPlural(count int, unit string) string {
 	if count == 1 {
-		return unit + " ago"
+		return unit
 	}
-	return fmt.Sprintf("%d %ss ago", count, strings.SplitN(unit, " ", 2)[1])
+	return fmt.Sprintf("%d %ss", count, strings.SplitN(unit, " ", 2)[1])
 }
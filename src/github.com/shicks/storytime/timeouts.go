@@ -0,0 +1,52 @@
+package storytime
+
+import (
+	"fmt"
+	"time"
+)
+
+// Task that reminds next authors who have been idle too long, skips them
+// once their turn times out, and ends stories whose deadline has passed
+// (or archives them, if nothing has been written).
+func checkTimeouts(r request) response {
+	now := time.Now()
+	// Deadlines are in whole hours, so nothing younger than an hour is due.
+	for _, story := range r.store().IdleStories(now.Add(-time.Hour)) {
+		checkTimeout(r, story, now)
+	}
+	return errorResponse{200, "OK"}
+}
+
+func checkTimeout(r request, story Story, now time.Time) {
+	defer func() {
+		// Don't let one broken story hold up the rest.
+		if e := recover(); e != nil {
+			r.errorf("Failed to check timeout for story %s: %v", story.Id, e)
+		}
+	}()
+	partId := story.NextId
+	if story.EndRule == endAtDeadline && !now.Before(story.Deadline) && len(story.Parts) == 0 {
+		// There's nothing to read, so it's put away rather than completed.
+		story.Archived = true
+		story.addEvent("", eventArchived, "")
+		r.store().UpdateStory(&story, partId, Queued{})
+	} else if story.EndRule == endAtDeadline && !now.Before(story.Deadline) {
+		story.Complete = true
+		story.addEvent("", eventEnded, "")
+		r.store().UpdateStory(&story, partId, Queued{Deliveries: eventDeliveries(r.store(), eventStoryCompleted, story, "")})
+	} else if due := story.TimeoutDue(); !due.IsZero() && !now.Before(due) {
+		author := story.NextAuthor
+		story.SkipNextAuthor()
+		story.addEvent(author, eventTimedOut, "")
+		outbox := []OutboxMessage{noticeMail(r, story.Id, author, "Your turn has been skipped.",
+			fmt.Sprintf("You didn't write your part within %d hours, so your turn in the story at %s/story/%s was skipped.",
+				story.TimeoutHours, config.BaseURL, story.Id))}
+		r.store().UpdateStory(&story, partId, Queued{
+			Outbox:     append(outbox, maybeTurnMail(r, story)...),
+			Deliveries: eventDeliveries(r.store(), eventTurnAssigned, story, story.NextAuthor),
+		})
+	} else if due := story.ReminderDue(); !due.IsZero() && !now.Before(due) {
+		story.LastReminder = now
+		r.store().UpdateStory(&story, partId, Queued{Outbox: reminderMail(r, story)})
+	}
+}
@@ -0,0 +1,98 @@
+package storytime
+
+// Personal API tokens, for clients like the command-line tool that can't
+// log in with a browser.  Clients send "Authorization: Bearer TOKEN";
+// only a hash of each token is stored, so it's shown to the user once,
+// when it's created.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often LastUsed is updated, as for sessions.
+const apiTokenTouchInterval = 10 * time.Minute
+
+// A personal API token.
+type APIToken struct {
+	// Hex SHA-256 of the token, which is also the key.
+	Hash string
+	// The user the token acts as.
+	Email string
+	// The user's description of what the token is for.
+	Label string
+	// When the token was created.
+	Created time.Time
+	// When the token was last used (to within apiTokenTouchInterval),
+	// or the zero time.
+	LastUsed time.Time
+}
+
+// Sorts tokens by Created, oldest first.
+type byCreated []APIToken
+
+func (a byCreated) Len() int           { return len(a) }
+func (a byCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byCreated) Less(i, j int) bool { return a[i].Created.Before(a[j].Created) }
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the user whose API token the request carries, nil if it
+// carries none, and panics with a 401 if the token isn't valid.
+func apiTokenUser(r request) *User {
+	auth := r.req.Header.Get("Authorization")
+	if auth == "" {
+		return nil
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		panic(jsonError(http.StatusUnauthorized, "Unsupported authorization"))
+	}
+	token := r.store().GetAPIToken(hashAPIToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))))
+	if token == nil {
+		panic(jsonError(http.StatusUnauthorized, "Invalid or revoked API token"))
+	}
+	if now := time.Now(); now.Sub(token.LastUsed) > apiTokenTouchInterval {
+		token.LastUsed = now
+		r.store().PutAPIToken(*token)
+	}
+	return &User{Email: token.Email}
+}
+
+// Handles /settings/tokens, where users create and revoke API tokens.
+func apiTokens(r request) response {
+	if r.matchPath("/settings/tokens") == nil {
+		return notFound
+	}
+	u := r.userRequired()
+	page := &apiTokensPage{}
+	if r.req.Method == "POST" {
+		switch r.req.FormValue("action") {
+		case "create":
+			page.NewToken = randomString(40)
+			r.store().PutAPIToken(APIToken{
+				Hash:    hashAPIToken(page.NewToken),
+				Email:   u.Email,
+				Label:   strings.TrimSpace(r.req.FormValue("label")),
+				Created: time.Now(),
+			})
+		case "revoke":
+			token := r.store().GetAPIToken(r.req.FormValue("hash"))
+			if token == nil || token.Email != u.Email {
+				return errorResponse{404, "Not Found: no such token"}
+			}
+			r.store().DeleteAPIToken(token.Hash)
+			return redirect("/settings/tokens")
+		default:
+			return errorResponse{400, "Unknown action"}
+		}
+	}
+	page.Tokens = r.store().UserAPITokens(u.Email)
+	page.BaseURL = config.BaseURL
+	return execute(page)
+}
@@ -0,0 +1,181 @@
+package storytime
+
+// The order authors take turns in.  Each story picks a turn order when
+// it's begun, and the order decides who goes first and who goes next,
+// both when a part is written and when a turn is skipped.
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Turn orders.
+const (
+	// Authors take turns in the order they're listed.
+	orderRoundRobin = ""
+	// Each round, every author takes a turn, in a new random order.
+	orderShuffled = "shuffled"
+	// Any author may be next, except whoever just had a turn.
+	orderRandom = "random"
+	// The author who has gone longest without a turn (whether they wrote
+	// or it was skipped) is next.
+	orderLeastRecent = "leastrecent"
+)
+
+// Decides who takes each turn in a story.
+type turnOrder interface {
+	// Returns the first author of a new story.
+	first(s *Story) string
+	// Returns the author after s.NextAuthor, whose turn is over.
+	next(s *Story) string
+}
+
+var turnOrders = map[string]turnOrder{
+	orderRoundRobin:  roundRobinOrder{},
+	orderShuffled:    shuffledOrder{},
+	orderRandom:      randomOrder{},
+	orderLeastRecent: leastRecentOrder{},
+}
+
+// Returns the story's turn order.
+func (s Story) turnOrder() turnOrder {
+	if order, ok := turnOrders[s.TurnOrder]; ok {
+		return order
+	}
+	panic(fmt.Errorf("Unknown turn order %q for story %s", s.TurnOrder, s.Id))
+}
+
+// Passes the turn on from the next author, to whoever the turn order
+// says is next.
+func (s *Story) advanceTurn() {
+	s.NextAuthor = s.turnOrder().next(s)
+}
+
+// Returns the story's authors other than the next author, or just the
+// next author if there are no others.
+func (s Story) otherAuthors() []string {
+	others := make([]string, 0, len(s.Authors))
+	for _, a := range s.Authors {
+		if a != s.NextAuthor {
+			others = append(others, a)
+		}
+	}
+	if len(others) == 0 {
+		return []string{s.NextAuthor}
+	}
+	return others
+}
+
+type roundRobinOrder struct{}
+
+func (roundRobinOrder) first(s *Story) string {
+	return s.Authors[0]
+}
+
+func (roundRobinOrder) next(s *Story) string {
+	return findNextAuthor(s.Authors, s.NextAuthor)
+}
+
+// Keeps the rest of the current round in Story.Round.
+type shuffledOrder struct{}
+
+func (shuffledOrder) first(s *Story) string {
+	round := shuffled(s.Authors)
+	s.Round = round[1:]
+	return round[0]
+}
+
+func (shuffledOrder) next(s *Story) string {
+	// Authors may have been removed (or skipped by being removed) since
+	// the round began.
+	var round []string
+	for _, a := range s.Round {
+		if a != s.NextAuthor && s.HasAuthor(a) {
+			round = append(round, a)
+		}
+	}
+	if len(round) == 0 {
+		round = shuffled(s.Authors)
+		// Don't give anyone two turns in a row across rounds.
+		if len(round) > 1 && round[0] == s.NextAuthor {
+			i := 1 + randomIntn(len(round)-1)
+			round[0], round[i] = round[i], round[0]
+		}
+	}
+	s.Round = round[1:]
+	return round[0]
+}
+
+// Returns the authors in a random order.
+func shuffled(authors []string) []string {
+	result := append([]string(nil), authors...)
+	for i := len(result) - 1; i > 0; i-- {
+		j := randomIntn(i + 1)
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// Returns a random number in [0, n).  It comes from crypto/rand, like
+// the story IDs, so that turns can't be predicted from them.
+func randomIntn(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(i.Int64())
+}
+
+type randomOrder struct{}
+
+func (randomOrder) first(s *Story) string {
+	return s.Authors[randomIntn(len(s.Authors))]
+}
+
+func (randomOrder) next(s *Story) string {
+	others := s.otherAuthors()
+	return others[randomIntn(len(others))]
+}
+
+type leastRecentOrder struct{}
+
+func (leastRecentOrder) first(s *Story) string {
+	return s.Authors[0]
+}
+
+// A skipped or timed-out turn counts as a turn, so that an idle author
+// isn't handed the next one straight back.  Ties, such as between authors
+// who haven't had a turn yet, go to whoever is first in the list after
+// the next author, as in roundRobinOrder.
+func (leastRecentOrder) next(s *Story) string {
+	last := make(map[string]time.Time)
+	for _, part := range s.Parts {
+		last[part.Author] = part.Written
+	}
+	for _, event := range s.History {
+		if (event.Event == eventSkipped || event.Event == eventTimedOut) && event.Time.After(last[event.Author]) {
+			last[event.Author] = event.Time
+		}
+	}
+	others := s.otherAuthors()
+	// Start the search after the next author, if they're still listed.
+	start := 0
+	if s.HasAuthor(s.NextAuthor) {
+		after := findNextAuthor(s.Authors, s.NextAuthor)
+		for i, a := range others {
+			if a == after {
+				start = i
+			}
+		}
+	}
+	best := others[start]
+	for i := 1; i < len(others); i++ {
+		a := others[(start+i)%len(others)]
+		if last[a].Before(last[best]) {
+			best = a
+		}
+	}
+	return best
+}
@@ -0,0 +1,99 @@
+package storytime
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the authors of the story's first n turns under its turn order.
+func testTurns(s Story, n int) []string {
+	s.NextAuthor = s.turnOrder().first(&s)
+	turns := []string{s.NextAuthor}
+	for len(turns) < n {
+		s.advanceTurn()
+		turns = append(turns, s.NextAuthor)
+	}
+	return turns
+}
+
+func TestRoundRobinOrder(t *testing.T) {
+	s := Story{Authors: []string{"a", "b", "c"}}
+	want := []string{"a", "b", "c", "a", "b"}
+	if got := testTurns(s, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("turns = %v, want %v", got, want)
+	}
+}
+
+func TestShuffledOrder(t *testing.T) {
+	authors := []string{"a", "b", "c", "d"}
+	for i := 0; i < 20; i++ {
+		turns := testTurns(Story{TurnOrder: orderShuffled, Authors: authors}, 3*len(authors))
+		for round := 0; round < 3; round++ {
+			seen := make(map[string]bool)
+			for _, a := range turns[round*len(authors) : (round+1)*len(authors)] {
+				seen[a] = true
+			}
+			if len(seen) != len(authors) {
+				t.Fatalf("turns = %v: round %d doesn't give everyone a turn", turns, round)
+			}
+		}
+		for j := 1; j < len(turns); j++ {
+			if turns[j] == turns[j-1] {
+				t.Fatalf("turns = %v: %s has two turns in a row", turns, turns[j])
+			}
+		}
+	}
+}
+
+func TestRandomOrder(t *testing.T) {
+	turns := testTurns(Story{TurnOrder: orderRandom, Authors: []string{"a", "b", "c"}}, 100)
+	seen := make(map[string]bool)
+	for j, a := range turns {
+		seen[a] = true
+		if j > 0 && a == turns[j-1] {
+			t.Fatalf("turns = %v: %s has two turns in a row", turns, a)
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("turns = %v: not everyone has a turn", turns)
+	}
+	if got := testTurns(Story{TurnOrder: orderRandom, Authors: []string{"a"}}, 3); !reflect.DeepEqual(got, []string{"a", "a", "a"}) {
+		t.Errorf("turns with one author = %v", got)
+	}
+}
+
+func TestLeastRecentOrder(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	at := func(minutes int) time.Time {
+		return start.Add(time.Duration(minutes) * time.Minute)
+	}
+	tests := []struct {
+		name    string
+		parts   []StoryPart
+		history []StoryEvent
+		next    string
+		want    string
+	}{
+		{"no parts", nil, nil, "a", "b"},
+		{"never written goes first", []StoryPart{{Author: "a", Written: at(1)}}, nil, "c", "b"},
+		{"longest ago", []StoryPart{{Author: "b", Written: at(1)}, {Author: "c", Written: at(2)}, {Author: "a", Written: at(3)}},
+			nil, "a", "b"},
+		{"skipped counts as a turn", []StoryPart{{Author: "a", Written: at(1)}},
+			[]StoryEvent{{Time: at(2), Author: "b", Event: eventSkipped}}, "c", "a"},
+		{"timed out counts as a turn", []StoryPart{{Author: "a", Written: at(1)}},
+			[]StoryEvent{{Time: at(2), Author: "b", Event: eventTimedOut}}, "c", "a"},
+		{"nudges don't count", []StoryPart{{Author: "a", Written: at(1)}},
+			[]StoryEvent{{Time: at(2), Author: "b", Event: eventNudged}}, "c", "b"},
+		{"written since skipped", []StoryPart{{Author: "b", Written: at(3)}, {Author: "a", Written: at(4)}},
+			[]StoryEvent{{Time: at(1), Author: "b", Event: eventSkipped}}, "c", "b"},
+	}
+	for _, test := range tests {
+		s := Story{TurnOrder: orderLeastRecent, Authors: []string{"a", "b", "c"}, Parts: test.parts,
+			History: test.history, NextAuthor: test.next}
+		s.advanceTurn()
+		if s.NextAuthor != test.want {
+			t.Errorf("%s: next author = %s, want %s", test.name, s.NextAuthor, test.want)
+		}
+	}
+}
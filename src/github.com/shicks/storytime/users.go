@@ -2,81 +2,30 @@ package storytime
 
 import (
 	"fmt"
-
-	"appengine"
-	"appengine/datastore"
-	"appengine/memcache"
+	"time"
 )
 
 // Conditionally adds a name to the name store (and cache).
 // Does nothing if a name is already set for thie email.
-func putNameForEmailIfAbsent(c appengine.Context, name, email string) {
-	existing := getNameFromEmail(c, email)
+func putNameForEmailIfAbsent(s StoryStore, name, email string) {
+	existing := s.GetName(email)
 	if existing == nil {
-		putNameForEmail(c, name, email)
-	}
-}
-
-// Stores a name for the given email.
-func putNameForEmail(c appengine.Context, name, email string) {
-	key := datastore.NewKey(c, "UserInfo", email, 0, nil)
-	if _, err := datastore.Put(c, key, &UserInfo{email, name}); err != nil {
-		return // best effort
-	}
-	cacheNameForEmail(c, name, email)
-}
-
-// Retrieves a name from the store (or cache).  Returns nil if no
-// name is set.
-func getNameFromEmail(c appengine.Context, email string) *string {
-	result, err := memcache.Get(c, "nameforemail:"+email)
-	var name string
-	if err != nil && err != memcache.ErrCacheMiss {
-		panic(&appError{err, "Unknown memcache error", 500}) // who knows what this could be...
-	}
-	if err == nil {
-		name = string(result.Value)
-		if name != "" {
-			return &name
-		}
-		return nil
+		s.PutName(name, email)
 	}
-	// Cache miss: go to datastore
-	info := new(UserInfo)
-	datastore.Get(c, datastore.NewKey(c, "UserInfo", email, 0, nil), info)
-	// TODO(sdh): due to a bug, this returns the wrong error
-	//if err != nil && err != datastore.ErrNoSuchEntity {
-	//	panic(&appError{err, "Unknown datastore error", 500}) // something weird
-	//}
-	if result != nil {
-		name = info.Name
-	}
-	cacheNameForEmail(c, name, email)
-	if name != "" {
-		return &name
-	}
-	return nil
 }
 
 // Adds the user's name, if available.
-func getFullEmail(c appengine.Context, email string) string {
-	name := getNameFromEmail(c, email)
+func getFullEmail(s StoryStore, email string) string {
+	name := s.GetName(email)
 	if name != nil {
 		return fmt.Sprintf("%s <%s>", *name, email)
 	}
 	return email
 }
 
-func cacheNameForEmail(c appengine.Context, name, email string) {
-	memcache.Set(c, &memcache.Item{
-		Key:   "nameforemail:" + email,
-		Value: []byte(name),
-	})
-}
-
-func nameFunc(c appengine.Context) func(string) string {
+func nameFunc(s StoryStore) func(string) string {
 	return func(email string) string {
-		name := getNameFromEmail(c, email)
+		name := s.GetName(email)
 		if name != nil {
 			return *name
 		}
@@ -84,8 +33,8 @@ func nameFunc(c appengine.Context) func(string) string {
 	}
 }
 
-func relativeNameFunc(c appengine.Context, self string) func(string) string {
-	f := nameFunc(c)
+func relativeNameFunc(s StoryStore, self string) func(string) string {
+	f := nameFunc(s)
 	return func(email string) string {
 		if email == self {
 			return "you"
@@ -94,15 +43,9 @@ func relativeNameFunc(c appengine.Context, self string) func(string) string {
 	}
 }
 
-func fullEmailFunc(c appengine.Context) func(string) string {
+func fullEmailFunc(s StoryStore) func(string) string {
 	return func(email string) string {
-		return getFullEmail(c, email)
-	}
-}
-
-func flushUserCache(c appengine.Context) {
-	if err := memcache.Flush(c); err != nil {
-		panic(&appError{err, "Error flushing memcache", 500})
+		return getFullEmail(s, email)
 	}
 }
 
@@ -111,4 +54,39 @@ type UserInfo struct {
 	Email string
 	// The user's preferred name
 	Name string
+	// How the user wants to hear about their turns: one of the notify
+	// constants below.
+	Notify string
+	// When the user was last sent a digest.
+	LastDigest time.Time
+	// Where to send chat messages: an XMPP address on App Engine, or a
+	// Matrix room ID when the Notifier comes from WithMatrixChat.
+	Chat string
+}
+
+// Notification preferences.
+const (
+	// Email as soon as it's the user's turn.  The zero value, so that
+	// users who never visited the settings page get the old behavior.
+	notifyImmediate = ""
+	// One email a day listing every story waiting on the user.
+	notifyDigest = "digest"
+	// No email at all; the user checks the site themselves.
+	notifyNone = "none"
+	// A chat message as soon as it's the user's turn, instead of email.
+	notifyChat = "chat"
+)
+
+// Returns whether the preference is for hearing about each turn as it
+// comes, by email or chat.
+func wantsTurnMessages(pref string) bool {
+	return pref == notifyImmediate || pref == notifyChat
+}
+
+// Returns the user's notification preference.
+func notifyPreference(s StoryStore, email string) string {
+	if info := s.GetUserInfo(email); info != nil {
+		return info.Notify
+	}
+	return notifyImmediate
 }
@@ -0,0 +1,386 @@
+package storytime
+
+// Outgoing webhooks.  Users subscribe a URL to events in all of their
+// stories, or in just one, and each event is POSTed to it as JSON.  The
+// body is signed with the subscription's secret, in the header
+//
+//   X-Storytime-Signature: sha256=HEX(HMAC-SHA256(secret, body))
+//
+// Events are queued as deliveries in the store when they happen, in the
+// same transaction as the story (like the outbox), and sent by the
+// /tasks/webhooks task, which retries failures with exponential backoff.
+// Each subscription's recent deliveries are shown on /settings/webhooks.
+//
+// Subscriptions may only point at public addresses, so that webhooks
+// can't be used to probe the server's own network.  The host is looked up
+// and checked when the subscription is made, and again for each delivery
+// (since its DNS may have changed in between).  Standalone servers check
+// each address as they connect to it, redirects included.  urlfetch on
+// App Engine resolves hosts itself, so there each request's host is
+// looked up and checked just before it's fetched, which leaves a DNS
+// change in between those two lookups uncaught.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Webhook events.
+const (
+	eventStoryCreated   = "story.created"
+	eventPartWritten    = "part.written"
+	eventTurnAssigned   = "turn.assigned"
+	eventStoryCompleted = "story.completed"
+)
+
+var webhookEvents = []string{eventStoryCreated, eventPartWritten, eventTurnAssigned, eventStoryCompleted}
+
+// Delivery states.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+const (
+	// Most deliveries sent by one run of the task.
+	webhookBatchSize = 50
+	// Attempts before a delivery is given up on.  With the delay
+	// doubling from a minute, the last is about four hours after the first.
+	maxWebhookAttempts = 9
+	// How long delivered and failed deliveries stay in the log.
+	deliveryLogLifetime = week
+	// Most deliveries shown for each subscription.
+	deliveryLogLength = 10
+)
+
+// A webhook subscription.
+type Webhook struct {
+	Id string
+	// The subscriber.  Only stories they're an author of are sent.
+	Email string
+	// The one story subscribed to, or "" for all of Email's stories.
+	StoryId string
+	// Where events are POSTed.
+	URL string
+	// Key for signing the bodies.
+	Secret string
+	// The events subscribed to.
+	Events []string
+	// When the subscription was made.
+	Created time.Time
+}
+
+// Returns whether the subscription wants the event in the given story.
+func (h Webhook) Wants(event, storyId string) bool {
+	if h.StoryId != "" && h.StoryId != storyId {
+		return false
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Sorts webhooks by Created, oldest first.
+type webhooksByCreated []Webhook
+
+func (a webhooksByCreated) Len() int           { return len(a) }
+func (a webhooksByCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a webhooksByCreated) Less(i, j int) bool { return a[i].Created.Before(a[j].Created) }
+
+// One event queued for (or sent to) one subscription.
+type WebhookDelivery struct {
+	Id        string
+	WebhookId string
+	// The story the event happened in.
+	StoryId string
+	Event   string
+	// The JSON body.
+	Payload string `datastore:",noindex"`
+	// When the event happened.
+	Created time.Time
+	// One of deliveryPending, deliveryDelivered or deliveryFailed.
+	State string
+	// How many times sending has been tried.
+	Attempts int
+	// When to try next, while pending.
+	NextAttempt time.Time
+	// When it was last tried, or the zero time.
+	LastAttempt time.Time
+	// The HTTP status of the last attempt, or 0 if there was no response.
+	Status int
+	// Why the last attempt failed, or "".
+	Error string `datastore:",noindex"`
+}
+
+// Sorts deliveries by Created, newest first.
+type deliveriesByCreated []WebhookDelivery
+
+func (a deliveriesByCreated) Len() int           { return len(a) }
+func (a deliveriesByCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a deliveriesByCreated) Less(i, j int) bool { return a[i].Created.After(a[j].Created) }
+
+// Sorts deliveries by NextAttempt, soonest first.
+type deliveriesByNextAttempt []WebhookDelivery
+
+func (a deliveriesByNextAttempt) Len() int      { return len(a) }
+func (a deliveriesByNextAttempt) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a deliveriesByNextAttempt) Less(i, j int) bool {
+	return a[i].NextAttempt.Before(a[j].NextAttempt)
+}
+
+// The body of a delivery.
+type webhookPayload struct {
+	// The delivery's ID, also sent as X-Storytime-Delivery.
+	Id    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Story apiStory  `json:"story"`
+	// The part just written, for part.written.
+	Part *apiPart `json:"part,omitempty"`
+	// The author who wrote the part, started the story, or (for
+	// turn.assigned) whose turn it now is.
+	Author string `json:"author,omitempty"`
+}
+
+// Returns the deliveries of the event to every subscription of the
+// story's authors that wants it, for saving along with the story.
+func eventDeliveries(s StoryStore, event string, story Story, author string) []WebhookDelivery {
+	var deliveries []WebhookDelivery
+	now := time.Now()
+	payload := webhookPayload{Event: event, Time: now, Story: newAPIStory(story), Author: author}
+	if event == eventPartWritten {
+		payload.Part = &payload.Story.Parts[len(payload.Story.Parts)-1]
+	}
+	seen := make(map[string]bool)
+	for _, email := range story.Authors {
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		for _, hook := range s.UserWebhooks(email) {
+			if !hook.Wants(event, story.Id) {
+				continue
+			}
+			payload.Id = randomString(16)
+			body, err := json.Marshal(payload)
+			if err != nil {
+				panic(&appError{err, "Failed to encode webhook", http.StatusInternalServerError})
+			}
+			deliveries = append(deliveries, WebhookDelivery{
+				Id:          payload.Id,
+				WebhookId:   hook.Id,
+				StoryId:     story.Id,
+				Event:       event,
+				Payload:     string(body),
+				Created:     now,
+				State:       deliveryPending,
+				NextAttempt: now,
+			})
+		}
+	}
+	return deliveries
+}
+
+// Signs a delivery's body.
+func signPayload(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait after the given number of failed attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	return time.Minute << uint(attempts-1)
+}
+
+// Task that sends the deliveries that are due.
+func deliverWebhooks(r request) response {
+	now := time.Now()
+	for _, d := range r.store().DueDeliveries(now, webhookBatchSize) {
+		deliverWebhook(r, d, now)
+	}
+	return errorResponse{200, "OK"}
+}
+
+// Tries to send one delivery, and records how it went.
+func deliverWebhook(r request, d WebhookDelivery, now time.Time) {
+	d.Attempts++
+	d.LastAttempt = now
+	d.Status = 0
+	d.Error = ""
+	hook := r.store().GetWebhook(d.WebhookId)
+	if hook == nil {
+		d.State = deliveryFailed
+		d.Error = "The subscription was deleted."
+	} else if d.Status, d.Error = postWebhook(r, *hook, d); d.Error == "" {
+		d.State = deliveryDelivered
+	} else if d.Attempts >= maxWebhookAttempts {
+		d.State = deliveryFailed
+	}
+	if d.State == deliveryPending {
+		d.NextAttempt = now.Add(webhookRetryDelay(d.Attempts))
+	} else {
+		d.NextAttempt = time.Time{}
+	}
+	r.store().PutDelivery(d)
+}
+
+// POSTs a delivery, returning the response status and, unless it was a
+// 2xx, what went wrong.  The response body is never read, since it's up
+// to the subscriber what's in it.
+func postWebhook(r request, hook Webhook, d WebhookDelivery) (int, string) {
+	req, err := http.NewRequest("POST", hook.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Storytime-Webhooks/1")
+	req.Header.Set("X-Storytime-Event", d.Event)
+	req.Header.Set("X-Storytime-Delivery", d.Id)
+	req.Header.Set("X-Storytime-Signature", signPayload(hook.Secret, d.Payload))
+	resp, err := host.webhookClient(r.req).Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// Checks a subscription's URL, returning why it's unusable, or "".
+func checkWebhookURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "Bad Request: the URL must be an absolute http or https URL"
+	}
+	if err := checkPublicHost(u); err != nil {
+		return "Bad Request: the URL's host must have a public address (" + err.Error() + ")"
+	}
+	return ""
+}
+
+// Returns an error unless every address of the URL's host is public.
+func checkPublicHost(u *url.URL) error {
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("could not look up %s", host)
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("%s is not a public address", ip)
+		}
+	}
+	return nil
+}
+
+// Private address ranges: RFC 1918 for IPv4, and unique local (RFC 4193)
+// for IPv6.  Checked by hand since net.IP.IsPrivate needs Go 1.17.
+var privateNets = []*net.IPNet{
+	parseCIDR("10.0.0.0/8"),
+	parseCIDR("172.16.0.0/12"),
+	parseCIDR("192.168.0.0/16"),
+	parseCIDR("fc00::/7"),
+}
+
+func parseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Returns whether an address is on the public internet, rather than
+// loopback, private or link-local.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// A subscription and its recent deliveries, for the settings page.
+type webhookLog struct {
+	Webhook
+	Deliveries []WebhookDelivery
+}
+
+// Handles /settings/webhooks, where users add and remove subscriptions
+// and see how their deliveries went.
+func webhooks(r request) response {
+	if r.matchPath("/settings/webhooks") == nil {
+		return notFound
+	}
+	u := r.userRequired()
+	if r.req.Method == "POST" {
+		switch r.req.FormValue("action") {
+		case "create":
+			hook := Webhook{
+				Id:      randomString(12),
+				Email:   u.Email,
+				StoryId: strings.TrimSpace(r.req.FormValue("story")),
+				URL:     strings.TrimSpace(r.req.FormValue("url")),
+				Secret:  randomString(32),
+				Created: time.Now(),
+			}
+			if problem := checkWebhookURL(hook.URL); problem != "" {
+				return errorResponse{400, problem}
+			}
+			if hook.StoryId != "" {
+				if story := r.store().FetchStory(hook.StoryId); story == nil || !story.HasAuthor(u.Email) {
+					return errorResponse{400, "Bad Request: you can only subscribe to stories you're writing"}
+				}
+			}
+			for _, event := range webhookEvents {
+				if r.req.FormValue(event) != "" {
+					hook.Events = append(hook.Events, event)
+				}
+			}
+			if len(hook.Events) == 0 {
+				return errorResponse{400, "Bad Request: choose at least one event"}
+			}
+			r.store().PutWebhook(hook)
+		case "delete":
+			hook := r.store().GetWebhook(r.req.FormValue("id"))
+			if hook == nil || hook.Email != u.Email {
+				return errorResponse{404, "Not Found: no such webhook"}
+			}
+			r.store().DeleteWebhook(hook.Id)
+		default:
+			return errorResponse{400, "Unknown action"}
+		}
+		return redirect("/settings/webhooks")
+	}
+	page := &webhooksPage{Events: webhookEvents}
+	for _, hook := range r.store().UserWebhooks(u.Email) {
+		page.Webhooks = append(page.Webhooks,
+			webhookLog{hook, r.store().WebhookDeliveries(hook.Id, deliveryLogLength)})
+	}
+	return execute(page)
+}
@@ -0,0 +1,149 @@
+package storytime
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"fdff::1", false},
+		{"fe00::1", true},
+		{"224.0.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+	}
+	for _, test := range tests {
+		if got := publicIP(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("publicIP(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://8.8.8.8/hook", true},
+		{"http://[2001:4860:4860::8888]:8080/hook", true},
+		{"ftp://8.8.8.8/hook", false},
+		{"/hook", false},
+		{"https:///hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://192.168.0.1/", false},
+	}
+	for _, test := range tests {
+		if problem := checkWebhookURL(test.url); (problem == "") != test.ok {
+			t.Errorf("checkWebhookURL(%q) = %q, want ok = %v", test.url, problem, test.ok)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{maxWebhookAttempts - 1, 128 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := webhookRetryDelay(test.attempts); got != test.want {
+			t.Errorf("webhookRetryDelay(%d) = %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	st, _ := setUpTest(nil)
+	status := http.StatusOK
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("X-Storytime-Signature") == signPayload("secret", string(body)) {
+			signature = "ok"
+		} else {
+			signature = "bad"
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("the subscriber's secrets"))
+	}))
+	defer server.Close()
+	hook := Webhook{Id: "hook", Email: "a@x.com", URL: server.URL, Secret: "secret", Events: webhookEvents}
+	st.PutWebhook(hook)
+	now := time.Now()
+	r := newTestRequest("POST", "/tasks/webhooks", nil)
+
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+		deleted  bool
+		// What the delivery should be left as.
+		state     string
+		error     string
+		nextDelay time.Duration
+	}{
+		{"delivered", http.StatusOK, 0, false, deliveryDelivered, "", 0},
+		{"no content", http.StatusNoContent, 3, false, deliveryDelivered, "", 0},
+		{"server error", http.StatusInternalServerError, 0, false, deliveryPending, "500 Internal Server Error", time.Minute},
+		{"retry", http.StatusBadGateway, 3, false, deliveryPending, "502 Bad Gateway", 8 * time.Minute},
+		{"last attempt", http.StatusNotFound, maxWebhookAttempts - 1, false, deliveryFailed, "404 Not Found", 0},
+		{"deleted", http.StatusOK, 0, true, deliveryFailed, "The subscription was deleted.", 0},
+	}
+	for _, test := range tests {
+		if test.deleted {
+			st.DeleteWebhook(hook.Id)
+		}
+		status = test.status
+		signature = ""
+		d := WebhookDelivery{Id: randomString(8), WebhookId: hook.Id, Event: eventPartWritten, Payload: `{"id":"1"}`,
+			Created: now, State: deliveryPending, Attempts: test.attempts, NextAttempt: now}
+		deliverWebhook(r, d, now)
+		var got *WebhookDelivery
+		saved := st.WebhookDeliveries(hook.Id, 100)
+		for i := range saved {
+			if saved[i].Id == d.Id {
+				got = &saved[i]
+			}
+		}
+		if got == nil {
+			t.Errorf("%s: delivery wasn't saved", test.name)
+			continue
+		}
+		if got.State != test.state || got.Error != test.error || got.Attempts != test.attempts+1 {
+			t.Errorf("%s: delivery is %s after %d attempts with error %q, want %s after %d with %q",
+				test.name, got.State, got.Attempts, got.Error, test.state, test.attempts+1, test.error)
+		}
+		if test.nextDelay == 0 && !got.NextAttempt.IsZero() || test.nextDelay != 0 && !got.NextAttempt.Equal(now.Add(test.nextDelay)) {
+			t.Errorf("%s: next attempt in %v, want %v", test.name, got.NextAttempt.Sub(now), test.nextDelay)
+		}
+		if !test.deleted && signature != "ok" {
+			t.Errorf("%s: signature was %q", test.name, signature)
+		}
+	}
+}